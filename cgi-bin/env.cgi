@@ -0,0 +1,4 @@
+#!/bin/sh
+
+printf "20 text/plain\r\n"
+echo "$(basename "$PWD") $SCRIPT_NAME $PATH_INFO"
@@ -4,8 +4,19 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func Lockdown(path string) {
-	unix.Unveil(path, "r w x c")
+// outbound also unveils what dialing out by name needs: the resolver
+// configuration and the system certificates
+func Lockdown(outbound bool, paths ...string) {
+	for _, path := range paths {
+		unix.Unveil(path, "r w x c")
+	}
+	promises := "stdio exec cpath rpath wpath fattr proc inet unix"
+	if outbound {
+		for _, path := range []string{"/etc/resolv.conf", "/etc/hosts", "/etc/ssl"} {
+			unix.Unveil(path, "r")
+		}
+		promises += " dns"
+	}
 	unix.UnveilBlock()
-	unix.PledgePromises("stdio exec cpath rpath wpath proc inet")
+	unix.PledgePromises(promises)
 }
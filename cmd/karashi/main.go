@@ -3,33 +3,110 @@ package main
 import (
 	"blekksprut.net/natto"
 	"blekksprut.net/natto/gemini"
-	"bufio"
+	"blekksprut.net/natto/misfin"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
-func serve(socket net.Conn, capsule *gemini.Capsule) {
-	defer socket.Close()
-	reader := bufio.NewReader(socket)
-	request, err := reader.ReadString('\n')
+type routes map[string]natto.Gateway
+
+func (r routes) String() string {
+	return ""
+}
+
+func (r routes) Set(s string) error {
+	route, backend, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected route=backend")
+	}
+	gateway, err := natto.ParseGateway(backend)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+	if gateway != nil {
+		r[route] = gateway
+		return nil
+	}
+	proxy := &gemini.Proxy{Backend: backend}
+	if b, ok := strings.CutPrefix(backend, "gemini://"); ok {
+		// gemini://host?fingerprint pins the backend's certificate
+		proxy.Backend, proxy.Fingerprint, _ = strings.Cut(b, "?")
+		proxy.TLS = true
+	}
+	if _, _, err := net.SplitHostPort(proxy.Backend); err != nil {
+		proxy.Backend = net.JoinHostPort(proxy.Backend, "1965")
+	}
+	r[route] = proxy
+	return nil
+}
+
+// the unix sockets scgi and fastcgi backends listen on, for the lockdown
+func (r routes) sockets() []string {
+	var paths []string
+	for _, gateway := range r {
+		switch g := gateway.(type) {
+		case *natto.Scgi:
+			if g.Network == "unix" {
+				paths = append(paths, g.Address)
+			}
+		case *natto.FastCgi:
+			if g.Network == "unix" {
+				paths = append(paths, g.Address)
+			}
+		}
+	}
+	return paths
+}
+
+// reports whether dir is root or somewhere under it, symlinks resolved
+func inside(dir, root string) bool {
+	if d, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = d
 	}
-	capsule.Handle(request, socket)
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+var ports = map[string]string{
+	"gemini": "1965",
+	"misfin": "1958",
 }
 
 func main() {
-	a := flag.String("a", ":1965", "address")
+	natto.Shim()
+	a := flag.String("a", "", "address (:1965, or :1958 for misfin)")
 	c := flag.String("c", "/etc/ssl/gemini.crt", "certificate")
+	C := flag.String("C", "", "accept titan uploads from these client certificates (comma separated sha256 fingerprints)")
+	f := flag.String("f", "", "configuration file")
 	k := flag.String("k", "/etc/ssl/private/gemini.key", "private key")
+	m := flag.String("m", "/var/misfin", "misfin mailbox directory, outside every served root")
+	strict := flag.Bool("H", false, "validate cgi response headers")
+	n := flag.Bool("n", false, "check the configuration and exit")
+	p := flag.String("p", "gemini", "protocol (gemini or misfin)")
+	P := flag.String("P", "", "forward proxy for these hosts (comma separated patterns, private addresses and other ports than the usual only when named exactly)")
 	r := flag.String("r", "/var/gemini", "root directory")
+	S := flag.String("S", "", "accept misfin mail only from these senders (comma separated patterns)")
+	R := routes{}
+	flag.Var(R, "R", "proxy route to a backend (/path=host:port, host=gemini://host[?fingerprint], /path=scgi://host:port, /path=fastcgi:///run/app.sock)")
+	flag.Var(&natto.CgiLimits, "l", "cgi limits, 0 for none (cpu=seconds,memory=size,filesize=size)")
+	t := flag.Duration("t", natto.CgiLimits.Timeout, "cgi timeout")
+	T := flag.String("T", "", "accept titan uploads with these tokens (comma separated)")
+	u := flag.Bool("u", false, "skip pledge/seccomp lockdown")
 	v := flag.Bool("v", false, "version")
+	x := flag.Bool("x", false, "treat executable files as cgi")
+	X := flag.Bool("X", false, "disable cgi")
 
 	flag.Parse()
 
@@ -38,38 +115,186 @@ func main() {
 		os.Exit(0)
 	}
 
-	cert, err := tls.LoadX509KeyPair(*c, *k)
+	conf := &natto.Config{}
+	if *f != "" {
+		var err error
+		conf, err = natto.LoadConfig(*f)
+		if err == nil {
+			err = conf.Check([]string{"gemini+tls", "misfin+tls"},
+				"certificate", "mailboxes", "cgi-processes", "max-connections", "route")
+		}
+		if err == nil {
+			err = conf.Flags(flag.CommandLine, map[string]string{
+				"root":         "r",
+				"mailboxes":    "m",
+				"strict":       "H",
+				"cgi-timeout":  "t",
+				"cgi-cpu":      "l",
+				"cgi-memory":   "l",
+				"cgi-filesize": "l",
+			})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	natto.CgiLimits.Timeout = *t
+	natto.CgiLimits.Processes = conf.CgiProcesses
+	for _, b := range conf.Backends {
+		if _, ok := R[b.Route]; ok {
+			continue
+		}
+		if err := R.Set(b.Route + "=" + b.URL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	listen := conf.Listen
+	if len(listen) == 0 {
+		if _, ok := ports[*p]; !ok {
+			log.Fatalf("unknown protocol %s", *p)
+		}
+		listen = []natto.Listen{{Protocol: *p, Addr: *a}}
+	}
+
+	config, err := conf.TLS()
 	if err != nil {
-		log.Fatal("keypair trouble")
+		log.Fatal(err)
+	}
+	given := false
+	flag.Visit(func(f *flag.Flag) { given = given || f.Name == "c" || f.Name == "k" })
+	if config == nil || given {
+		cert, err := tls.LoadX509KeyPair(*c, *k)
+		if err != nil {
+			log.Fatal("keypair trouble")
+		}
+		config = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+		}
+	}
+	var hosts []string
+	var fingerprint string
+	for _, cert := range config.Certificates {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Fatal("certificate trouble")
+		}
+		if fingerprint == "" {
+			fingerprint = misfin.Fingerprint(leaf)
+		}
+		hosts = append(hosts, leaf.DNSNames...)
+		hosts = append(hosts, leaf.Subject.CommonName)
 	}
-	config := tls.Config{
-		Certificates: []tls.Certificate{cert},
+	roots, err := conf.Roots()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	path, err := filepath.Abs(*r)
 	if err != nil {
 		log.Fatal("invalid root path")
 	}
+	mailboxes, err := filepath.Abs(*m)
+	if err != nil {
+		log.Fatal("invalid mailbox path")
+	}
+	// delivered mail mustn't land in, or overwrite, what gemini serves
+	misfins := slices.ContainsFunc(listen, func(l natto.Listen) bool { return l.Protocol == "misfin" })
+	if misfins {
+		for _, root := range append([]string{path}, slices.Collect(maps.Values(roots))...) {
+			if inside(mailboxes, root) {
+				log.Fatalf("mailboxes %s are inside the served root %s", mailboxes, root)
+			}
+		}
+	}
 
 	err = os.Chdir(path)
 	if err != nil {
 		log.Fatal("unable to chdir to root directory")
 	}
-	Lockdown(path)
+	if !*n {
+		err = conf.Apply()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !*u && !*n {
+		dirs := []string{path}
+		for _, root := range roots {
+			dirs = append(dirs, root)
+		}
+		if misfins {
+			dirs = append(dirs, mailboxes)
+		}
+		// proxies and misfin's sender checks dial out by name
+		outbound := *P != "" || len(R) > 0 || misfins
+		Lockdown(outbound, append(dirs, R.sockets()...)...)
+	}
 
-	capsule := &gemini.Capsule{Root: path}
-	server, err := tls.Listen("tcp", *a, &config)
-	if err != nil {
-		log.Fatal(err)
+	cgi := natto.CgiRules{Off: *X, Executable: *x}
+	if conf.Cgi != nil {
+		cgi = *conf.Cgi
+		cgi.Off = cgi.Off || *X
+		cgi.Executable = cgi.Executable || *x
+	}
+	build := func(protocol, root string) natto.Capsule {
+		if protocol == "misfin" {
+			postbox := &misfin.Postbox{Root: mailboxes, Hosts: hosts, Fingerprint: fingerprint}
+			if *S != "" {
+				postbox.Senders = strings.Split(*S, ",")
+			}
+			return postbox
+		}
+		gem := &gemini.Capsule{
+			Root:      root,
+			Strict:    *strict,
+			Cgi:       cgi,
+			Gateways:  R,
+			Redirects: conf.Redirects,
+			Index:     conf.Index,
+			Listing:   conf.Listing,
+		}
+		if *P != "" {
+			gem.Hosts = hosts
+			gem.Forward = &gemini.Forward{Hosts: strings.Split(*P, ",")}
+		}
+		if *T != "" || *C != "" {
+			gem.Titan = &gemini.Titan{}
+			if *T != "" {
+				gem.Titan.Tokens = strings.Split(*T, ",")
+			}
+			if *C != "" {
+				gem.Titan.Certs = strings.Split(*C, ",")
+			}
+		}
+		return gem
 	}
-	defer server.Close()
 
-	log.Printf("listening on %s\n", *a)
-	for {
-		socket, err := server.Accept()
-		if err != nil {
-			log.Printf("unacceptable: %v", err)
+	daemon := &natto.Daemon{MaxConns: conf.MaxConns, Access: conf.Access}
+	for _, l := range listen {
+		if l.Addr == "" {
+			l.Addr = ":" + ports[l.Protocol]
+		}
+		capsule := build(l.Protocol, path)
+		if len(roots) > 0 && l.Protocol != "misfin" {
+			vhosts := &natto.Vhosts{Hosts: map[string]natto.Capsule{}, Default: capsule}
+			for host, root := range roots {
+				vhosts.Hosts[host] = build(l.Protocol, root)
+			}
+			capsule = vhosts
 		}
-		go serve(socket, capsule)
+		daemon.Listeners = append(daemon.Listeners, natto.Listener{
+			Protocol: l.Protocol,
+			Addr:     l.Addr,
+			TLS:      config,
+			Serve:    func(socket net.Conn) { natto.Serve(socket, capsule) },
+		})
+	}
+
+	if *n {
+		fmt.Println("configuration OK")
+		os.Exit(0)
 	}
+	log.Fatal(daemon.Run())
 }
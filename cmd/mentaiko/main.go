@@ -1,18 +1,123 @@
 package main
 
 import (
+	"blekksprut.net/natto/gemtext"
 	"blekksprut.net/natto/spartan"
+	"bufio"
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 )
 
+var stdin = bufio.NewReader(os.Stdin)
+
+func fetch(ctx context.Context, u string, data []byte, status bool) ([]gemtext.Line, *spartan.Response) {
+	d := spartan.Data{Length: int64(len(data)), Data: bytes.NewReader(data)}
+	res, err := spartan.Request(ctx, u, d)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil
+	}
+	defer res.Close()
+
+	switch res.Status {
+	case spartan.ClientError, spartan.ServerError:
+		fmt.Fprintln(os.Stderr, res.Status, res.Header)
+	case spartan.Success:
+		if status {
+			fmt.Fprintln(os.Stderr, res.Status, res.Header)
+		}
+		if !strings.HasPrefix(res.Header, "text/gemini") {
+			io.Copy(os.Stdout, res)
+			return nil, res
+		}
+		var buf bytes.Buffer
+		io.Copy(io.MultiWriter(os.Stdout, &buf), res)
+		lines, _ := gemtext.Parse(&buf)
+		return lines, res
+	}
+	return nil, res
+}
+
+func prompts(lines []gemtext.Line) []gemtext.Line {
+	var found []gemtext.Line
+	for _, line := range lines {
+		if line.Kind == "=:" {
+			found = append(found, line)
+		}
+	}
+	return found
+}
+
+func ask(question string) (string, bool) {
+	fmt.Fprint(os.Stderr, question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", false
+	}
+	return strings.TrimSpace(answer), true
+}
+
+func compose() []byte {
+	fmt.Fprintln(os.Stderr, "(end with a line containing only .)")
+	var buf bytes.Buffer
+	for {
+		line, err := stdin.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+		buf.WriteString(line)
+		if err != nil {
+			break
+		}
+	}
+	return buf.Bytes()
+}
+
+func interact(ctx context.Context, u string, data []byte, status bool) {
+	for {
+		lines, res := fetch(ctx, u, data, status)
+		found := prompts(lines)
+		if len(found) == 0 {
+			return
+		}
+		fmt.Fprintln(os.Stderr)
+		for i, line := range found {
+			label := line.Label
+			if label == "" {
+				label = line.URL
+			}
+			fmt.Fprintf(os.Stderr, "[%d] %s\n", i+1, label)
+		}
+		answer, ok := ask("prompt (empty to quit): ")
+		if !ok || answer == "" {
+			return
+		}
+		i, err := strconv.Atoi(answer)
+		if err != nil || i < 1 || i > len(found) {
+			fmt.Fprintln(os.Stderr, "no such prompt")
+			return
+		}
+		next, err := res.URL.Parse(found[i-1].URL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		u, data = next.String(), compose()
+	}
+}
+
 func main() {
 	ctx := context.Background()
 
+	d := flag.String("d", "", "send this string as data")
+	D := flag.String("D", "", "send this file as data (- for stdin)")
+	i := flag.Bool("i", false, "interactive, fill in =: prompts")
 	s := flag.Bool("s", false, "print status line")
 
 	flag.Parse()
@@ -22,26 +127,33 @@ func main() {
 		os.Exit(0)
 	}
 
-	for _, u := range flag.Args() {
-		if !strings.HasPrefix(u, "spartan://") {
-			u = "spartan://" + u
-		}
+	if *D == "-" && *i {
+		fmt.Fprintln(os.Stderr, "-D - and -i both want stdin")
+		os.Exit(1)
+	}
 
-		res, err := spartan.Request(ctx, u, spartan.Data{})
+	data := []byte(*d)
+	if *D != "" {
+		var err error
+		if *D == "-" {
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(*D)
+		}
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
-			continue
+			os.Exit(1)
 		}
-		defer res.Close()
+	}
 
-		switch res.Status {
-		case spartan.ClientError, spartan.ServerError:
-			fmt.Fprintln(os.Stderr, res.Status, res.Header)
-		case spartan.Success:
-			if *s {
-				fmt.Fprintln(os.Stderr, res.Status, res.Header)
-			}
-			io.Copy(os.Stdout, res)
+	for _, u := range flag.Args() {
+		if !strings.HasPrefix(u, "spartan://") {
+			u = "spartan://" + u
+		}
+		if *i {
+			interact(ctx, u, data, *s)
+		} else {
+			fetch(ctx, u, data, *s)
 		}
 	}
 }
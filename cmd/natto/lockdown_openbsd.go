@@ -4,8 +4,18 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func Lockdown(path string) {
-	unix.Unveil(path, "r w x c")
+// outbound lets the server reach scgi and fastcgi backends, by name too
+func Lockdown(outbound bool, paths ...string) {
+	for _, path := range paths {
+		unix.Unveil(path, "r w x c")
+	}
+	promises := "stdio exec cpath rpath wpath proc"
+	if outbound {
+		for _, path := range []string{"/etc/resolv.conf", "/etc/hosts"} {
+			unix.Unveil(path, "r")
+		}
+		promises += " inet unix dns"
+	}
 	unix.UnveilBlock()
-	unix.PledgePromises("stdio exec cpath rpath wpath proc")
+	unix.PledgePromises(promises)
 }
@@ -2,20 +2,80 @@ package main
 
 import (
 	"blekksprut.net/natto"
+	"blekksprut.net/natto/finger"
 	"blekksprut.net/natto/gemini"
+	"blekksprut.net/natto/gopher"
+	"blekksprut.net/natto/nex"
 	"blekksprut.net/natto/spartan"
 	"bufio"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// scgi and fastcgi backends by path. proxying to other capsules is
+// karashi's business
+type routes map[string]natto.Gateway
+
+func (r routes) String() string {
+	return ""
+}
+
+func (r routes) Set(s string) error {
+	route, backend, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected route=backend")
+	}
+	gateway, err := natto.ParseGateway(backend)
+	if err != nil {
+		return err
+	}
+	if gateway == nil {
+		return fmt.Errorf("%s isn't an scgi:// or fastcgi:// backend", backend)
+	}
+	r[route] = gateway
+	return nil
+}
+
+// the unix sockets scgi and fastcgi backends listen on, for the lockdown
+func (r routes) sockets() []string {
+	var paths []string
+	for _, gateway := range r {
+		switch g := gateway.(type) {
+		case *natto.Scgi:
+			if g.Network == "unix" {
+				paths = append(paths, g.Address)
+			}
+		case *natto.FastCgi:
+			if g.Network == "unix" {
+				paths = append(paths, g.Address)
+			}
+		}
+	}
+	return paths
+}
+
 func main() {
+	natto.Shim()
+	f := flag.String("f", "", "configuration file")
+	strict := flag.Bool("H", false, "validate cgi response headers")
+	n := flag.Bool("n", false, "check the configuration and exit")
+	p := flag.String("p", "gemini", "protocol (gemini, spartan, gopher, finger or nex)")
 	r := flag.String("r", "/var/gemini", "root directory")
-	s := flag.Bool("s", false, "spartan 💪")
+	R := routes{}
+	flag.Var(R, "R", "route gemini and spartan paths to a backend (/path=scgi://host:port, /path=fastcgi:///run/app.sock)")
+	s := flag.Bool("s", false, "spartan 💪 (same as -p spartan)")
+	S := flag.String("S", "", "server name for gopher menus, host[:port] (default hostname)")
+	flag.Var(&natto.CgiLimits, "l", "cgi limits, 0 for none (cpu=seconds,memory=size,filesize=size)")
+	t := flag.Duration("t", natto.CgiLimits.Timeout, "cgi timeout")
+	u := flag.Bool("u", false, "skip pledge/seccomp lockdown")
 	v := flag.Bool("v", false, "version")
+	x := flag.Bool("x", false, "treat executable files as cgi")
+	X := flag.Bool("X", false, "disable cgi")
 	flag.Parse()
 
 	if *v {
@@ -23,6 +83,48 @@ func main() {
 		os.Exit(0)
 	}
 
+	conf := &natto.Config{}
+	if *f != "" {
+		var err error
+		conf, err = natto.LoadConfig(*f)
+		if err == nil {
+			err = conf.Check(nil, "route")
+		}
+		if err == nil {
+			err = conf.Flags(flag.CommandLine, map[string]string{
+				"root":         "r",
+				"strict":       "H",
+				"cgi-timeout":  "t",
+				"cgi-cpu":      "l",
+				"cgi-memory":   "l",
+				"cgi-filesize": "l",
+			})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	natto.CgiLimits.Timeout = *t
+	if *s {
+		*p = "spartan"
+	}
+	for _, b := range conf.Backends {
+		if _, ok := R[b.Route]; ok {
+			continue
+		}
+		if err := R.Set(b.Route + "=" + b.URL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(R) > 0 && *p != "gemini" && *p != "spartan" {
+		log.Fatalf("%s can't route to backends", *p)
+	}
+
+	roots, err := conf.Roots()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	path, err := filepath.Abs(*r)
 	if err != nil {
 		log.Fatal("invalid root path")
@@ -32,13 +134,75 @@ func main() {
 	if err != nil {
 		log.Fatal("unable to chdir to root directory")
 	}
-	Lockdown(path)
+	if !*n {
+		err = conf.Apply()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(conf.Access) > 0 && !*n {
+		conn, err := net.FileConn(os.Stdin)
+		if err != nil || !conf.Access.Permits(conn.RemoteAddr()) {
+			log.Fatal("access denied")
+		}
+		conn.Close()
+	}
+	if !*u && !*n {
+		dirs := []string{path}
+		for _, root := range roots {
+			dirs = append(dirs, root)
+		}
+		Lockdown(len(R) > 0, append(dirs, R.sockets()...)...)
+	}
 
-	var capsule natto.Capsule
-	if *s {
-		capsule = &spartan.Space{Root: path}
-	} else {
-		capsule = &gemini.Capsule{Root: path}
+	cgi := natto.CgiRules{Off: *X, Executable: *x}
+	if conf.Cgi != nil {
+		cgi = *conf.Cgi
+		cgi.Off = cgi.Off || *X
+		cgi.Executable = cgi.Executable || *x
+	}
+	build := func(root string) natto.Capsule {
+		switch *p {
+		case "spartan":
+			return &spartan.Space{Root: root, Strict: *strict, Cgi: cgi, Redirects: conf.Redirects, Gateways: R}
+		case "gopher":
+			host, port := *S, "70"
+			if h, p, err := net.SplitHostPort(*S); err == nil {
+				host, port = h, p
+			}
+			if host == "" {
+				host, _ = os.Hostname()
+			}
+			return &gopher.Hole{Root: root, Cgi: cgi, Host: host, Port: port}
+		case "finger":
+			return &finger.Hand{Root: root, Cgi: cgi}
+		case "nex":
+			return &nex.Station{Root: root}
+		case "gemini":
+			return &gemini.Capsule{
+				Root:      root,
+				Strict:    *strict,
+				Cgi:       cgi,
+				Redirects: conf.Redirects,
+				Index:     conf.Index,
+				Listing:   conf.Listing,
+				Gateways:  R,
+			}
+		}
+		log.Fatalf("unknown protocol %s", *p)
+		return nil
+	}
+	capsule := build(path)
+	if len(roots) > 0 {
+		vhosts := &natto.Vhosts{Hosts: map[string]natto.Capsule{}, Default: capsule}
+		for host, root := range roots {
+			vhosts.Hosts[host] = build(root)
+		}
+		capsule = vhosts
+	}
+	if *n {
+		fmt.Println("configuration OK")
+		os.Exit(0)
 	}
 
 	reader := bufio.NewReader(os.Stdin)
@@ -46,5 +210,5 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	capsule.Handle(request, &natto.Stdio{})
+	capsule.Handle(request, &natto.Stdio{Reader: reader})
 }
@@ -1,8 +1,8 @@
-//go:build !openbsd
-// +build !openbsd
+//go:build !openbsd && !linux
+// +build !openbsd,!linux
 
 package main
 
-func Lockdown(path string) {
+func Lockdown(outbound bool, paths ...string) {
 	return
 }
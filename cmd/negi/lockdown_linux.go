@@ -0,0 +1,26 @@
+package main
+
+import (
+	"blekksprut.net/natto"
+	"blekksprut.net/natto/seccomp"
+	"log"
+)
+
+// outbound lets the server reach scgi and fastcgi backends
+func Lockdown(outbound bool, paths ...string) {
+	// the filter outlives execve, so scripts start from a launcher set up
+	// before it. without one the server has to run them itself
+	promises := "stdio cpath rpath wpath fattr inet"
+	if outbound {
+		promises += " unix"
+	}
+	err := natto.StartLauncher()
+	if err != nil {
+		log.Printf("launcher trouble: %v", err)
+		promises += " exec proc"
+	}
+	err = seccomp.Pledge(promises)
+	if err != nil {
+		log.Printf("seccomp trouble: %v", err)
+	}
+}
@@ -2,48 +2,221 @@ package main
 
 import (
 	"blekksprut.net/natto"
+	"blekksprut.net/natto/finger"
 	"blekksprut.net/natto/gemini"
+	"blekksprut.net/natto/gopher"
+	"blekksprut.net/natto/guppy"
+	"blekksprut.net/natto/nex"
 	"blekksprut.net/natto/spartan"
-	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-func serve(socket net.Conn, capsule natto.Capsule) {
-	defer socket.Close()
-	reader := bufio.NewReader(socket)
-	request, err := reader.ReadString('\n')
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// scgi and fastcgi backends by path. proxying to other capsules is
+// karashi's business
+type routes map[string]natto.Gateway
+
+func (r routes) String() string {
+	return ""
+}
+
+func (r routes) Set(s string) error {
+	route, backend, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected route=backend")
+	}
+	gateway, err := natto.ParseGateway(backend)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+	if gateway == nil {
+		return fmt.Errorf("%s isn't an scgi:// or fastcgi:// backend", backend)
 	}
-	capsule.Handle(request, socket)
+	r[route] = gateway
+	return nil
+}
+
+// the unix sockets scgi and fastcgi backends listen on, for the lockdown
+func (r routes) sockets() []string {
+	var paths []string
+	for _, gateway := range r {
+		switch g := gateway.(type) {
+		case *natto.Scgi:
+			if g.Network == "unix" {
+				paths = append(paths, g.Address)
+			}
+		case *natto.FastCgi:
+			if g.Network == "unix" {
+				paths = append(paths, g.Address)
+			}
+		}
+	}
+	return paths
+}
+
+type vhosts map[string]string
+
+func (v vhosts) String() string {
+	return ""
+}
+
+func (v vhosts) Set(s string) error {
+	host, root, ok := strings.Cut(s, "=")
+	if !ok || host == "" || root == "" {
+		return fmt.Errorf("expected host=root")
+	}
+	path, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	v[host] = path
+	return nil
+}
+
+var ports = map[string]string{
+	"gemini":  "1965",
+	"spartan": "300",
+	"gopher":  "70",
+	"finger":  "79",
+	"nex":     "1900",
+	"guppy":   "6775",
+	"mux":     "1965",
 }
 
 func main() {
+	natto.Shim()
+	a := flag.String("a", "", "address (:1965, :300, :70, :79, :1900 or :6775 depending on protocol)")
+	c := flag.String("c", "", "certificate, for gemini over tls (-p mux or -L gemini+tls)")
+	d := flag.String("d", "", "store spartan uploads in these directories (comma separated)")
+	f := flag.String("f", "", "configuration file")
+	strict := flag.Bool("H", false, "validate cgi response headers")
+	J := flag.Int("J", 0, "maximum concurrent cgi scripts (0 for no limit)")
+	k := flag.String("k", "", "private key, for gemini over tls (-p mux or -L gemini+tls)")
+	L := list{}
+	flag.Var(&L, "L", "listen for a protocol, repeatable (protocol[=address], gemini+tls for tls)")
+	M := flag.Int("M", 0, "maximum connections across all listeners (0 for no limit)")
+	m := flag.String("m", "gopher", "protocol for bare selectors with -p mux (gopher or nex)")
+	n := flag.Bool("n", false, "check the configuration and exit")
+	o := flag.Bool("o", false, "let spartan uploads overwrite existing files")
+	p := flag.String("p", "gemini", "protocol (gemini, spartan, gopher, finger, nex, guppy, or mux to sniff)")
 	r := flag.String("r", "/var/gemini", "root directory")
-	s := flag.Bool("s", false, "spartan 💪")
+	R := routes{}
+	flag.Var(R, "R", "route gemini and spartan paths to a backend (/path=scgi://host:port, /path=fastcgi:///run/app.sock)")
+	s := flag.Bool("s", false, "spartan 💪 (same as -p spartan)")
+	S := flag.String("S", "", "server name for gopher menus, host[:port] (default hostname)")
+	flag.Var(&natto.CgiLimits, "l", "cgi limits, 0 for none (cpu=seconds,memory=size,filesize=size)")
+	t := flag.Duration("t", natto.CgiLimits.Timeout, "cgi timeout")
+	u := flag.Bool("u", false, "skip pledge/seccomp lockdown")
 	v := flag.Bool("v", false, "version")
+	V := vhosts{}
+	flag.Var(V, "V", "serve a host from its own root, repeatable (host=root)")
+	w := flag.String("w", "", "also serve gemini over http on this address")
+	y := flag.String("y", "", "only take spartan uploads of these mime types (comma separated)")
+	z := natto.Size(1 << 20)
+	flag.Var(&z, "z", "largest spartan upload (1M, 512K...)")
+	x := flag.Bool("x", false, "treat executable files as cgi")
+	X := flag.Bool("X", false, "disable cgi")
 
 	flag.Parse()
 
-	var a *string
-	if *s {
-		a = flag.String("a", ":300", "address")
-	} else {
-		a = flag.String("a", ":1965", "address")
+	conf := &natto.Config{}
+	if *f != "" {
+		var err error
+		conf, err = natto.LoadConfig(*f)
+		if err == nil {
+			err = conf.Check([]string{"gemini", "gemini+tls", "spartan", "gopher", "finger", "nex", "guppy", "mux"},
+				"certificate", "cgi-processes", "max-connections", "route", "upload-size", "upload-types")
+		}
+		if err == nil {
+			err = conf.Flags(flag.CommandLine, map[string]string{
+				"root":            "r",
+				"strict":          "H",
+				"cgi-timeout":     "t",
+				"cgi-cpu":         "l",
+				"cgi-memory":      "l",
+				"cgi-filesize":    "l",
+				"cgi-processes":   "J",
+				"max-connections": "M",
+				"upload-size":     "z",
+				"upload-types":    "y",
+			})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	flag.Parse()
+	if *s {
+		*p = "spartan"
+	}
+	if len(L) == 0 {
+		for _, l := range conf.Listen {
+			if l.TLS {
+				l.Protocol += "+tls"
+			}
+			L = append(L, l.Protocol+"="+l.Addr)
+		}
+	}
+	if len(L) == 0 {
+		L = list{*p + "=" + *a}
+	}
 
 	if *v {
 		fmt.Println(os.Args[0], natto.Version)
 		os.Exit(0)
 	}
+	natto.CgiLimits.Timeout = *t
+	natto.CgiLimits.Processes = *J
+	for _, b := range conf.Backends {
+		if _, ok := R[b.Route]; ok {
+			continue
+		}
+		if err := R.Set(b.Route + "=" + b.URL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	config, err := conf.TLS()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *c != "" {
+		cert, err := tls.LoadX509KeyPair(*c, *k)
+		if err != nil {
+			log.Fatal("keypair trouble")
+		}
+		config = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+		}
+	}
+	roots, err := conf.Roots()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for host, root := range roots {
+		if _, ok := V[host]; !ok {
+			V[host] = root
+		}
+	}
 
 	path, err := filepath.Abs(*r)
 	if err != nil {
@@ -54,27 +227,123 @@ func main() {
 	if err != nil {
 		log.Fatal("unable to chdir to root directory")
 	}
-	Lockdown(path)
+	if !*n {
+		err = conf.Apply()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !*u && !*n {
+		roots := []string{path}
+		for _, root := range V {
+			roots = append(roots, root)
+		}
+		Lockdown(len(R) > 0, append(roots, R.sockets()...)...)
+	}
 
-	var capsule natto.Capsule
-	if *s {
-		capsule = &spartan.Space{Root: path}
-	} else {
-		capsule = &gemini.Capsule{Root: path}
+	cgi := natto.CgiRules{Off: *X, Executable: *x}
+	if conf.Cgi != nil {
+		cgi = *conf.Cgi
+		cgi.Off = cgi.Off || *X
+		cgi.Executable = cgi.Executable || *x
+	}
+	build := func(protocol, root, addr string) natto.Capsule {
+		switch protocol {
+		case "spartan":
+			space := &spartan.Space{Root: root, Strict: *strict, Cgi: cgi, Redirects: conf.Redirects, Gateways: R}
+			if *d != "" {
+				space.Uploads = &spartan.Uploads{Dirs: strings.Split(*d, ","), MaxSize: int64(z), Overwrite: *o}
+				if *y != "" {
+					space.Uploads.Types = strings.Split(*y, ",")
+				}
+			}
+			return space
+		case "gopher":
+			_, port, _ := net.SplitHostPort(addr)
+			host := *S
+			if h, p, err := net.SplitHostPort(*S); err == nil {
+				host, port = h, p
+			}
+			if host == "" {
+				host, _ = os.Hostname()
+			}
+			return &gopher.Hole{Root: root, Cgi: cgi, Host: host, Port: port}
+		case "finger":
+			return &finger.Hand{Root: root, Cgi: cgi}
+		case "nex":
+			return &nex.Station{Root: root}
+		}
+		return &gemini.Capsule{
+			Root:      root,
+			Strict:    *strict,
+			Cgi:       cgi,
+			Redirects: conf.Redirects,
+			Index:     conf.Index,
+			Listing:   conf.Listing,
+			Gateways:  R,
+		}
+	}
+	site := func(protocol, addr string) natto.Capsule {
+		capsule := build(protocol, path, addr)
+		if len(V) == 0 {
+			return capsule
+		}
+		hosts := &natto.Vhosts{Hosts: map[string]natto.Capsule{}, Default: capsule}
+		for host, root := range V {
+			hosts.Hosts[host] = build(protocol, root, addr)
+		}
+		return hosts
 	}
 
-	server, err := net.Listen("tcp", *a)
-	if err != nil {
-		log.Fatal(err)
+	daemon := &natto.Daemon{MaxConns: *M, Access: conf.Access}
+	for _, spec := range L {
+		protocol, addr, _ := strings.Cut(spec, "=")
+		protocol, secure := strings.CutSuffix(protocol, "+tls")
+		port, ok := ports[protocol]
+		if !ok || (secure && protocol != "gemini") {
+			log.Fatalf("unknown protocol %s", spec)
+		}
+		if addr == "" {
+			addr = ":" + port
+		}
+		if secure && config == nil {
+			log.Fatalf("%s needs a certificate (-c and -k)", spec)
+		}
+		listener := natto.Listener{Protocol: protocol, Addr: addr}
+		switch protocol {
+		case "guppy":
+			tank := &guppy.Tank{Capsule: site("gemini", addr)}
+			listener.Packets = tank.Serve
+		case "mux":
+			mux := &natto.Mux{TLS: config}
+			mux.Gemini, mux.Spartan, mux.Selector = site("gemini", addr), site("spartan", addr), site(*m, addr)
+			listener.Serve = mux.Serve
+		default:
+			capsule := site(protocol, addr)
+			if secure {
+				listener.TLS = config
+			}
+			listener.Serve = func(socket net.Conn) { natto.Serve(socket, capsule) }
+		}
+		daemon.Listeners = append(daemon.Listeners, listener)
 	}
-	defer server.Close()
 
-	log.Printf("listening on %s\n", *a)
-	for {
-		socket, err := server.Accept()
+	if *n {
+		fmt.Println("configuration OK")
+		os.Exit(0)
+	}
+
+	if *w != "" {
+		web, err := net.Listen("tcp", *w)
 		if err != nil {
-			log.Printf("unacceptable: %v", err)
+			log.Fatal(err)
 		}
-		go serve(socket, capsule)
+		log.Printf("mirroring over http on %s\n", *w)
+		mirror := &gemini.Mirror{Capsule: build("gemini", path, *w).(*gemini.Capsule)}
+		go func() {
+			log.Fatal(http.Serve(web, mirror))
+		}()
 	}
+
+	log.Fatal(daemon.Run())
 }
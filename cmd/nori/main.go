@@ -0,0 +1,250 @@
+package main
+
+import (
+	"blekksprut.net/natto"
+	"blekksprut.net/natto/gemini"
+	"blekksprut.net/natto/gemtext"
+	"blekksprut.net/natto/spartan"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var page = template.Must(template.New("page").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 40em; margin: 1em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.4 }
+pre { overflow-x: auto }
+blockquote { border-left: 2px solid #999; margin-left: 0; padding-left: 1em }
+.link:before { content: "⇒ " }
+form.bar { display: flex }
+form.bar input { flex: 1 }
+textarea, input { display: block; width: 100%; margin: .5em 0 }
+</style>
+</head>
+<body>
+<form class="bar" action="/"><input name="url" value="{{.URL}}" placeholder="gemini:// or spartan://"><button>go</button></form>
+{{.Body}}
+</body>
+</html>
+`))
+
+type view struct {
+	Title string
+	URL   string
+	Body  template.HTML
+}
+
+func portal(u *url.URL) string {
+	switch u.Scheme {
+	case "gemini", "spartan":
+		p := "/" + u.Scheme + "/" + u.Host + u.EscapedPath()
+		if u.RawQuery != "" {
+			p += "?" + u.RawQuery
+		}
+		return p
+	case "http", "https", "gopher":
+		return u.String()
+	}
+	return ""
+}
+
+func target(r *http.Request) (*url.URL, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	host, p, _ := strings.Cut(rest, "/")
+	if host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	raw := scheme + "://" + host + "/" + p
+	if r.URL.RawQuery != "" {
+		raw += "?" + r.URL.RawQuery
+	}
+	return url.Parse(raw)
+}
+
+func render(w http.ResponseWriter, status int, v view) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	page.Execute(w, v)
+}
+
+func failure(w http.ResponseWriter, status int, u string, msg string) {
+	body := template.HTML("<p>" + template.HTMLEscapeString(msg) + "</p>")
+	render(w, status, view{Title: msg, URL: u, Body: body})
+}
+
+func prompt(w http.ResponseWriter, u *url.URL, label string, sensitive bool) {
+	kind := "text"
+	if sensitive {
+		kind = "password"
+	}
+	body := fmt.Sprintf("<form method=\"post\" action=\"%s\"><label>%s "+
+		"<input type=\"%s\" name=\"input\" autofocus></label><button>send</button></form>",
+		template.HTMLEscapeString(portal(u)), template.HTMLEscapeString(label), kind)
+	render(w, http.StatusOK, view{Title: label, URL: u.String(), Body: template.HTML(body)})
+}
+
+func show(w http.ResponseWriter, u *url.URL, mimetype string, body io.Reader) {
+	if mimetype == "" {
+		mimetype = "text/gemini"
+	}
+	kind, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		kind = "application/octet-stream"
+	}
+	switch {
+	case kind == "text/gemini":
+		var buf bytes.Buffer
+		gemtext.HTML(&buf, body, func(link string) string {
+			ref, err := u.Parse(link)
+			if err != nil {
+				return ""
+			}
+			return portal(ref)
+		})
+		render(w, http.StatusOK, view{Title: u.String(), URL: u.String(), Body: template.HTML(buf.String())})
+	case kind == "text/plain":
+		// anything the browser could run gets downloaded instead, so a
+		// capsule can't script the portal's origin
+		w.Header().Set("Content-Type", mimetype)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.Copy(w, body)
+	default:
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = u.Hostname()
+		}
+		w.Header().Set("Content-Type", mimetype)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		io.Copy(w, body)
+	}
+}
+
+func geminiPage(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	if r.Method == http.MethodPost {
+		u.RawQuery = url.PathEscape(r.FormValue("input"))
+		http.Redirect(w, r, portal(u), http.StatusSeeOther)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	res, err := gemini.Request(ctx, u.String())
+	if err != nil {
+		failure(w, http.StatusBadGateway, u.String(), err.Error())
+		return
+	}
+	defer res.Close()
+	if res.URL.String() != u.String() {
+		http.Redirect(w, r, portal(res.URL), http.StatusFound)
+		return
+	}
+
+	switch res.Status / 10 {
+	case 1:
+		prompt(w, u, res.Header, res.Status == gemini.SensitiveInput)
+	case 2:
+		show(w, u, res.Header, res)
+	case 4:
+		failure(w, http.StatusServiceUnavailable, u.String(), fmt.Sprintf("%d %s", res.Status, res.Header))
+	case 5:
+		failure(w, http.StatusNotFound, u.String(), fmt.Sprintf("%d %s", res.Status, res.Header))
+	case 6:
+		failure(w, http.StatusForbidden, u.String(), "client certificates are not supported")
+	default:
+		failure(w, http.StatusBadGateway, u.String(), fmt.Sprintf("unknown status %d", res.Status))
+	}
+}
+
+func spartanPage(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	d := spartan.Data{}
+	if r.Method == http.MethodPost {
+		data := r.FormValue("data")
+		d = spartan.Data{Length: int64(len(data)), Data: strings.NewReader(data)}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	res, err := spartan.Request(ctx, u.String(), d)
+	if err != nil {
+		failure(w, http.StatusBadGateway, u.String(), err.Error())
+		return
+	}
+	defer res.Close()
+	if res.URL.Path != u.Path {
+		http.Redirect(w, r, portal(res.URL), http.StatusFound)
+		return
+	}
+
+	meta := strings.TrimSpace(res.Header)
+	switch res.Status {
+	case spartan.Success:
+		show(w, u, meta, res)
+	case spartan.ClientError:
+		failure(w, http.StatusNotFound, u.String(), fmt.Sprintf("%d %s", res.Status, meta))
+	default:
+		failure(w, http.StatusBadGateway, u.String(), fmt.Sprintf("%d %s", res.Status, meta))
+	}
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		raw := r.FormValue("url")
+		if raw == "" {
+			render(w, http.StatusOK, view{Title: "nori"})
+			return
+		}
+		if !strings.Contains(raw, "://") {
+			raw = "gemini://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || portal(u) == "" {
+			failure(w, http.StatusBadRequest, raw, "invalid url")
+			return
+		}
+		http.Redirect(w, r, portal(u), http.StatusFound)
+		return
+	}
+
+	u, err := target(r)
+	if err != nil {
+		failure(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	switch u.Scheme {
+	case "gemini":
+		geminiPage(w, r, u)
+	case "spartan":
+		spartanPage(w, r, u)
+	default:
+		failure(w, http.StatusNotFound, "", "unsupported scheme")
+	}
+}
+
+func main() {
+	a := flag.String("a", "localhost:8080", "address")
+	v := flag.Bool("v", false, "version")
+	flag.Parse()
+
+	if *v {
+		fmt.Println(os.Args[0], natto.Version)
+		os.Exit(0)
+	}
+
+	log.Printf("listening on %s\n", *a)
+	log.Fatal(http.ListenAndServe(*a, http.HandlerFunc(handle)))
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"blekksprut.net/natto"
 	"blekksprut.net/natto/gemini"
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,10 +13,68 @@ import (
 	"strings"
 )
 
+func show(res *gemini.Response, status bool) {
+	switch res.Status / 10 {
+	case 1:
+		fmt.Fprintln(os.Stderr, "Input requests not supported")
+	case 6:
+		fmt.Fprintln(os.Stderr, "Client certificate support not yet implemented")
+	case 4, 5:
+		fmt.Fprintln(os.Stderr, res.Status, res.Header)
+	case 2:
+		if status {
+			fmt.Fprintln(os.Stderr, res.Status, res.Header)
+		}
+		switch {
+		case strings.HasPrefix(res.Header, "text/"):
+			io.Copy(os.Stdout, res)
+		default:
+			fmt.Fprintln(os.Stderr, "only text responses supported for now")
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown status code", res.Status)
+	}
+}
+
+// titan takes an empty upload as a delete, which -D asks for explicitly
+var errEmpty = errors.New("refusing to upload nothing, which deletes (-D to delete)")
+
+func upload(ctx context.Context, u, file, mime, token string, stdin []byte) (*gemini.Response, error) {
+	if file == "-" {
+		if mime == "" {
+			mime = "text/gemini"
+		}
+		if len(stdin) == 0 {
+			return nil, errEmpty
+		}
+		return gemini.Upload(ctx, u, mime, token, bytes.NewReader(stdin), int64(len(stdin)))
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, errEmpty
+	}
+	if mime == "" {
+		mime = natto.Mime(file)
+	}
+	return gemini.Upload(ctx, u, mime, token, f, info.Size())
+}
+
 func main() {
 	ctx := context.Background()
 
+	D := flag.Bool("D", false, "delete over titan")
+	m := flag.String("m", "", "mime type of the upload")
 	s := flag.Bool("s", false, "print status line")
+	T := flag.String("T", "", "titan token")
+	U := flag.String("U", "", "upload this file (- for stdin) over titan")
 
 	flag.Parse()
 
@@ -21,38 +82,41 @@ func main() {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *D && *U != "" {
+		fmt.Fprintln(os.Stderr, "-D and -U don't go together")
+		os.Exit(1)
+	}
+
+	var stdin []byte
+	if *U == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		stdin = data
+	}
 
 	for _, u := range flag.Args() {
-		if !strings.HasPrefix(u, "gemini://") {
+		if !strings.Contains(u, "://") {
 			u = "gemini://" + u
 		}
 
-		res, err := gemini.Request(ctx, u)
+		var res *gemini.Response
+		var err error
+		switch {
+		case *D:
+			res, err = gemini.Upload(ctx, u, "", *T, bytes.NewReader(nil), 0)
+		case *U != "":
+			res, err = upload(ctx, u, *U, *m, *T, stdin)
+		default:
+			res, err = gemini.Request(ctx, u)
+		}
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			continue
 		}
 		defer res.Close()
-
-		switch res.Status / 10 {
-		case 1:
-			fmt.Fprintln(os.Stderr, "Input requests not supported")
-		case 6:
-			fmt.Fprintln(os.Stderr, "Client certificate support not yet implemented")
-		case 4, 5:
-			fmt.Fprintln(os.Stderr, res.Status, res.Header)
-		case 2:
-			if *s {
-				fmt.Fprintln(os.Stderr, res.Status, res.Header)
-			}
-			switch {
-			case strings.HasPrefix(res.Header, "text/"):
-				io.Copy(os.Stdout, res)
-			default:
-				fmt.Fprintln(os.Stderr, "only text responses supported for now")
-			}
-		default:
-			fmt.Fprintln(os.Stderr, "Unknown status code", res.Status)
-		}
+		show(res, *s)
 	}
 }
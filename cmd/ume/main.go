@@ -0,0 +1,31 @@
+package main
+
+import (
+	"blekksprut.net/natto/finger"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	ctx := context.Background()
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	for _, q := range flag.Args() {
+		res, err := finger.Request(ctx, q)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		defer res.Close()
+		io.Copy(os.Stdout, res)
+	}
+}
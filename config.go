@@ -0,0 +1,415 @@
+package natto
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var Protocols = []string{"gemini", "spartan", "gopher", "finger", "nex", "guppy", "mux", "misfin"}
+
+type Listen struct {
+	Protocol string
+	Addr     string
+	TLS      bool
+	Line     int
+}
+
+type Host struct {
+	Name string
+	Root string
+	Line int
+}
+
+type Backend struct {
+	Route string
+	URL   string
+	Line  int
+}
+
+type Certificate struct {
+	Cert string
+	Key  string
+	Line int
+}
+
+// a configuration file, one directive per line:
+//
+//	root /var/gemini
+//	listen gemini :1965 tls
+//	host example.com /var/example
+//	certificate /etc/ssl/gemini.crt /etc/ssl/private/gemini.key
+//	mailboxes /var/misfin
+//	route /app scgi:///run/app.sock | example.com gemini://backend
+//	upload-size 1M
+//	upload-types text/gemini text/plain ...
+//	cgi executable | off | dir cgi-bin ... | extension .cgi .sh ...
+//	cgi-timeout 30s
+//	cgi-processes 8
+//	cgi-cpu 10
+//	cgi-memory 256M
+//	cgi-filesize 16M
+//	strict
+//	max-connections 64
+//	redirect [permanent] /old/(.*) /new/$1
+//	gone /deleted.gmi
+//	index index.gmi index.cgi
+//	listing
+//	allow 10.0.0.0/8
+//	deny all
+//	mime .gmni text/gemini
+//	log /var/log/natto.log | stderr | off
+//
+// everything after a # is a comment
+type Config struct {
+	Name         string
+	Root         string
+	Listen       []Listen
+	Hosts        []Host
+	Certificates []Certificate
+	Backends     []Backend
+	Cgi          *CgiRules
+	CgiProcesses int
+	MaxConns     int
+	Redirects    Redirects
+	Index        []string
+	Listing      bool
+	Access       Access
+	Types        map[string]string
+	Log          string
+	lines        map[string]int
+	values       map[string]string
+}
+
+var arity = map[string][2]int{
+	"root":            {1, 1},
+	"listen":          {1, 3},
+	"host":            {2, 2},
+	"certificate":     {2, 2},
+	"mailboxes":       {1, 1},
+	"route":           {2, 2},
+	"upload-size":     {1, 1},
+	"upload-types":    {1, -1},
+	"cgi":             {1, -1},
+	"cgi-timeout":     {1, 1},
+	"cgi-processes":   {1, 1},
+	"cgi-cpu":         {1, 1},
+	"cgi-memory":      {1, 1},
+	"cgi-filesize":    {1, 1},
+	"strict":          {0, 0},
+	"max-connections": {1, 1},
+	"redirect":        {2, 3},
+	"gone":            {1, 1},
+	"index":           {1, -1},
+	"listing":         {0, 0},
+	"allow":           {1, -1},
+	"deny":            {1, -1},
+	"mime":            {2, 2},
+	"log":             {1, 1},
+}
+
+// copies single valued settings (root, strict, cgi-timeout...) into the
+// flags named for them, leaving flags given on the command line alone
+func (c *Config) Flags(set *flag.FlagSet, names map[string]string) error {
+	given := map[string]bool{}
+	set.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for directive, name := range names {
+		value, ok := c.values[directive]
+		if !ok || given[name] {
+			continue
+		}
+		err := set.Set(name, value)
+		if err != nil {
+			return c.errorf(c.lines[directive], "%s: %v", directive, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) errorf(line int, format string, a ...any) error {
+	return fmt.Errorf("%s:%d: %s", c.Name, line, fmt.Sprintf(format, a...))
+}
+
+func LoadConfig(name string) (*Config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseConfig(name, f)
+}
+
+func ParseConfig(name string, r io.Reader) (*Config, error) {
+	c := &Config{Name: name, Types: map[string]string{}, lines: map[string]int{}, values: map[string]string{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		err := c.directive(n, fields[0], fields[1:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) directive(n int, name string, args []string) error {
+	bounds, ok := arity[name]
+	if !ok {
+		return c.errorf(n, "unknown directive %s", name)
+	}
+	if len(args) < bounds[0] || (bounds[1] >= 0 && len(args) > bounds[1]) {
+		return c.errorf(n, "wrong number of arguments for %s", name)
+	}
+	switch name {
+	case "root", "mailboxes", "upload-size", "upload-types", "cgi-timeout", "cgi-processes",
+		"cgi-cpu", "cgi-memory", "cgi-filesize", "strict", "max-connections", "listing", "log":
+		if line, ok := c.lines[name]; ok {
+			return c.errorf(n, "%s already set on line %d", name, line)
+		}
+		c.values[name] = "true"
+		if len(args) > 0 {
+			c.values[name] = args[0]
+		}
+	}
+	if _, ok := c.lines[name]; !ok {
+		c.lines[name] = n
+	}
+
+	var err error
+	switch name {
+	case "root":
+		c.Root = args[0]
+	case "listen":
+		l := Listen{Protocol: args[0], Line: n}
+		if !slices.Contains(Protocols, l.Protocol) {
+			return c.errorf(n, "unknown protocol %s", l.Protocol)
+		}
+		for _, arg := range args[1:] {
+			if arg == "tls" {
+				l.TLS = true
+			} else if l.Addr == "" {
+				l.Addr = arg
+			} else {
+				return c.errorf(n, "unexpected %s", arg)
+			}
+		}
+		c.Listen = append(c.Listen, l)
+	case "host":
+		for _, h := range c.Hosts {
+			if strings.EqualFold(h.Name, args[0]) {
+				return c.errorf(n, "host %s already set on line %d", h.Name, h.Line)
+			}
+		}
+		c.Hosts = append(c.Hosts, Host{args[0], args[1], n})
+	case "certificate":
+		c.Certificates = append(c.Certificates, Certificate{args[0], args[1], n})
+	case "route":
+		for _, b := range c.Backends {
+			if b.Route == args[0] {
+				return c.errorf(n, "route %s already set on line %d", b.Route, b.Line)
+			}
+		}
+		_, err = ParseGateway(args[1])
+		c.Backends = append(c.Backends, Backend{args[0], args[1], n})
+	case "cgi":
+		if c.Cgi == nil {
+			c.Cgi = &CgiRules{}
+		}
+		err = c.cgi(args)
+	case "upload-size":
+		_, err = ParseSize(args[0])
+	case "upload-types":
+		for _, kind := range args {
+			if !strings.Contains(kind, "/") {
+				return c.errorf(n, "%s isn't a mime type", kind)
+			}
+		}
+		// one comma separated flag, like -y
+		c.values[name] = strings.Join(args, ",")
+	case "cgi-timeout":
+		// lands in the -t flag, checked here to point at the line
+		_, err = time.ParseDuration(args[0])
+	case "cgi-processes":
+		c.CgiProcesses, err = count(args[0])
+	case "cgi-cpu", "cgi-memory", "cgi-filesize":
+		// these all land in one -l flag, as key=value
+		c.values[name] = strings.TrimPrefix(name, "cgi-") + "=" + args[0]
+		err = (&Limits{}).Set(c.values[name])
+	case "max-connections":
+		c.MaxConns, err = count(args[0])
+	case "redirect", "gone":
+		r, err := ParseRedirect(name, args)
+		if err != nil {
+			return c.errorf(n, "%v", err)
+		}
+		c.Redirects = append(c.Redirects, r)
+	case "index":
+		for _, name := range args {
+			if strings.Contains(name, "/") {
+				return c.errorf(n, "index %s isn't a file name", name)
+			}
+		}
+		c.Index = append(c.Index, args...)
+	case "listing":
+		c.Listing = true
+	case "allow", "deny":
+		for _, arg := range args {
+			rule, err := ParseRule(name == "allow", arg)
+			if err != nil {
+				return c.errorf(n, "%v", err)
+			}
+			c.Access = append(c.Access, rule)
+		}
+	case "mime":
+		if !strings.HasPrefix(args[0], ".") || !strings.Contains(args[1], "/") {
+			return c.errorf(n, "expected mime .ext type/subtype")
+		}
+		c.Types[args[0]] = args[1]
+	case "log":
+		// opened by Apply, after the server has moved into its root
+		c.Log = args[0]
+		if c.Log != "stderr" && c.Log != "off" {
+			c.Log, err = filepath.Abs(c.Log)
+		}
+	}
+	if err != nil {
+		return c.errorf(n, "%s: %v", name, err)
+	}
+	return nil
+}
+
+func (c *Config) cgi(args []string) error {
+	if len(args) == 1 && (args[0] == "dir" || args[0] == "extension") {
+		return fmt.Errorf("%s needs at least one argument", args[0])
+	}
+	switch args[0] {
+	case "off":
+		c.Cgi.Off = true
+	case "executable":
+		c.Cgi.Executable = true
+	case "dir":
+		c.Cgi.Dirs = append(c.Cgi.Dirs, args[1:]...)
+	case "extension":
+		for _, ext := range args[1:] {
+			if !strings.HasPrefix(ext, ".") {
+				return fmt.Errorf("extension %s doesn't start with .", ext)
+			}
+		}
+		c.Cgi.Extensions = append(c.Cgi.Extensions, args[1:]...)
+	default:
+		return fmt.Errorf("expected off, executable, dir or extension")
+	}
+	return nil
+}
+
+func count(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("negative count")
+	}
+	return n, err
+}
+
+// directives only some commands honour. the rest apply everywhere
+var optional = []string{"certificate", "mailboxes", "cgi-processes", "max-connections", "route",
+	"upload-size", "upload-types"}
+
+// validates what the parser can't: the protocols this command serves, a
+// +tls suffix marking those it serves over tls, the optional directives
+// it honours, roots that exist and certificates that load
+func (c *Config) Check(protocols []string, directives ...string) error {
+	for _, l := range c.Listen {
+		switch {
+		case l.TLS && !slices.Contains(protocols, l.Protocol+"+tls"):
+			return c.errorf(l.Line, "%s over tls isn't served here", l.Protocol)
+		case !l.TLS && !slices.Contains(protocols, l.Protocol):
+			if slices.Contains(protocols, l.Protocol+"+tls") {
+				return c.errorf(l.Line, "%s is only served over tls here", l.Protocol)
+			}
+			return c.errorf(l.Line, "%s isn't served here", l.Protocol)
+		}
+	}
+	for _, name := range optional {
+		line, ok := c.lines[name]
+		if ok && !slices.Contains(directives, name) {
+			return c.errorf(line, "%s isn't supported here", name)
+		}
+	}
+	dirs := []Host{}
+	if c.Root != "" {
+		dirs = append(dirs, Host{Root: c.Root, Line: c.lines["root"]})
+	}
+	for _, h := range append(dirs, c.Hosts...) {
+		info, err := os.Stat(h.Root)
+		if err != nil || !info.IsDir() {
+			return c.errorf(h.Line, "%s isn't a directory", h.Root)
+		}
+	}
+	_, err := c.TLS()
+	return err
+}
+
+// the configured certificates, chosen between by sni. nil when
+// there are none
+func (c *Config) TLS() (*tls.Config, error) {
+	if len(c.Certificates) == 0 {
+		return nil, nil
+	}
+	config := &tls.Config{ClientAuth: tls.RequestClientCert}
+	for _, cert := range c.Certificates {
+		pair, err := tls.LoadX509KeyPair(cert.Cert, cert.Key)
+		if err != nil {
+			return nil, c.errorf(cert.Line, "keypair trouble: %v", err)
+		}
+		config.Certificates = append(config.Certificates, pair)
+	}
+	return config, nil
+}
+
+// roots, absolute, for the capsules and the lockdown
+func (c *Config) Roots() (map[string]string, error) {
+	roots := map[string]string{}
+	for _, h := range c.Hosts {
+		path, err := filepath.Abs(h.Root)
+		if err != nil {
+			return nil, c.errorf(h.Line, "invalid root path")
+		}
+		roots[h.Name] = path
+	}
+	return roots, nil
+}
+
+// sets up the process wide parts: mime types and logging
+func (c *Config) Apply() error {
+	for ext, mime := range c.Types {
+		Types[ext] = mime
+	}
+	switch c.Log {
+	case "", "stderr":
+	case "off":
+		log.SetOutput(io.Discard)
+	default:
+		f, err := os.OpenFile(c.Log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return c.errorf(c.lines["log"], "%v", err)
+		}
+		log.SetOutput(f)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package natto
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// one address a daemon listens on. tcp listeners hand each connection
+// to Serve, udp ones (guppy) get the whole socket through Packets
+type Listener struct {
+	Protocol string
+	Addr     string
+	TLS      *tls.Config
+	Serve    func(net.Conn)
+	Packets  func(net.PacketConn) error
+}
+
+// an allow or deny rule for a network, or for everyone when Net is nil
+type Rule struct {
+	Allow bool
+	Net   *net.IPNet
+}
+
+// rules checked in order, the first match deciding. addresses nothing
+// matches are let in unless there are allow rules
+type Access []Rule
+
+func ParseRule(allow bool, s string) (Rule, error) {
+	if s == "all" {
+		return Rule{Allow: allow}, nil
+	}
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return Rule{}, fmt.Errorf("invalid address %s", s)
+		}
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return Rule{allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid network %s", s)
+	}
+	return Rule{allow, network}, nil
+}
+
+func (a Access) Permits(addr net.Addr) bool {
+	if len(a) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	for _, rule := range a {
+		if rule.Net == nil || (ip != nil && rule.Net.Contains(ip)) {
+			return rule.Allow
+		}
+	}
+	return !slices.ContainsFunc(a, func(rule Rule) bool { return rule.Allow })
+}
+
+// ranges IsPrivate and friends leave out: "this network" and the
+// carrier grade nat space
+var reserved = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// reports whether ip is reachable from the internet at large, rather
+// than loopback, private, link local, multicast or reserved
+func IsPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsMulticast() &&
+		!slices.ContainsFunc(reserved, func(p netip.Prefix) bool { return p.Contains(ip) })
+}
+
+// a net.Dialer Control refusing addresses that aren't IsPublic. it sees
+// the address actually dialled, so a name can't be rebound past it
+func Public(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !IsPublic(addr.Addr()) {
+		return fmt.Errorf("%s isn't a public address", addr.Addr())
+	}
+	return nil
+}
+
+type dialerKey struct{}
+
+// has the gemini, spartan and gopher clients dial through d
+func WithDialer(ctx context.Context, d *net.Dialer) context.Context {
+	return context.WithValue(ctx, dialerKey{}, d)
+}
+
+// a copy of the dialer set by WithDialer, or a plain one
+func Dialer(ctx context.Context) net.Dialer {
+	if d, ok := ctx.Value(dialerKey{}).(*net.Dialer); ok {
+		return *d
+	}
+	return net.Dialer{}
+}
+
+type guarded struct {
+	net.PacketConn
+	access Access
+}
+
+func (g *guarded) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := g.PacketConn.ReadFrom(p)
+		if err != nil || g.access.Permits(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// runs several listeners in one process. they share the process wide
+// logger and cgi limits, and MaxConns caps connections across all of them
+type Daemon struct {
+	Listeners []Listener
+	MaxConns  int
+	Access    Access
+	conns     chan struct{}
+}
+
+// reads the request line and hands the connection to the capsule
+func Serve(socket net.Conn, capsule Capsule) {
+	defer socket.Close()
+	reader := bufio.NewReader(socket)
+	request, err := reader.ReadString('\n')
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	capsule.Handle(request, &Conn{Conn: socket, Reader: reader})
+}
+
+// opens every listener before serving any, so a bad address fails the
+// whole daemon at startup. returns when one of them stops
+func (d *Daemon) Run() error {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	var serves []func() error
+	for _, l := range d.Listeners {
+		if l.Packets != nil {
+			conn, err := net.ListenPacket("udp", l.Addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			closers = append(closers, conn)
+			log.Printf("%s listening on %s/udp\n", l.Protocol, l.Addr)
+			serves = append(serves, func() error { return l.Packets(&guarded{conn, d.Access}) })
+			continue
+		}
+		server, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		if l.TLS != nil {
+			server = tls.NewListener(server, l.TLS)
+		}
+		closers = append(closers, server)
+		log.Printf("%s listening on %s\n", l.Protocol, l.Addr)
+		serves = append(serves, func() error { return d.accept(server, l) })
+	}
+	defer closeAll()
+
+	if len(serves) == 0 {
+		return fmt.Errorf("no listeners")
+	}
+	if d.MaxConns > 0 {
+		d.conns = make(chan struct{}, d.MaxConns)
+	}
+	done := make(chan error, len(serves))
+	for _, serve := range serves {
+		go func() { done <- serve() }()
+	}
+	return <-done
+}
+
+func (d *Daemon) accept(server net.Listener, l Listener) error {
+	for {
+		socket, err := server.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			log.Printf("unacceptable: %v", err)
+			continue
+		}
+		if !d.Access.Permits(socket.RemoteAddr()) {
+			log.Printf("%s: denied %s", l.Protocol, socket.RemoteAddr())
+			socket.Close()
+			continue
+		}
+		if d.conns != nil {
+			d.conns <- struct{}{}
+		}
+		go func() {
+			l.Serve(socket)
+			if d.conns != nil {
+				<-d.conns
+			}
+		}()
+	}
+}
+
+// the host a request line names, for gemini style urls and spartan
+// requests. gopher selectors and the like don't carry one
+func RequestHost(request string) string {
+	if spartanRequest(request) {
+		return strings.Fields(request)[0]
+	}
+	u, err := url.Parse(strings.TrimSpace(request))
+	if err != nil || u.Scheme == "" {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// picks a capsule by the requested host, falling back to Default
+type Vhosts struct {
+	Hosts   map[string]Capsule
+	Default Capsule
+}
+
+func (v *Vhosts) Handle(request string, rw io.ReadWriter) error {
+	host := RequestHost(request)
+	for name, capsule := range v.Hosts {
+		if strings.EqualFold(name, host) {
+			return capsule.Handle(request, rw)
+		}
+	}
+	return v.Default.Handle(request, rw)
+}
@@ -0,0 +1,258 @@
+package natto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiKeepConn     = 1
+)
+
+// connections are kept open between requests. Conns caps both how many
+// requests the backend sees at once and how many idle connections wait
+type FastCgi struct {
+	Network string
+	Address string
+	Timeout time.Duration
+	Conns   int
+	Env     []string
+	mu      sync.Mutex
+	idle    []*fcgiConn
+	once    sync.Once
+	slots   chan struct{}
+}
+
+type fcgiConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (f *FastCgi) timeout() time.Duration {
+	if f.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return f.Timeout
+}
+
+func (f *FastCgi) acquire() error {
+	f.once.Do(func() {
+		if f.Conns == 0 {
+			f.Conns = 4
+		}
+		f.slots = make(chan struct{}, f.Conns)
+	})
+	select {
+	case f.slots <- struct{}{}:
+		return nil
+	case <-time.After(f.timeout()):
+		return fmt.Errorf("%w: no free fastcgi connections", ErrBackend)
+	}
+}
+
+func (f *FastCgi) release() {
+	<-f.slots
+}
+
+func (f *FastCgi) pooled() *fcgiConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.idle)
+	if n == 0 {
+		return nil
+	}
+	conn := f.idle[n-1]
+	f.idle = f.idle[:n-1]
+	return conn
+}
+
+func (f *FastCgi) dial() (*fcgiConn, error) {
+	network := f.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, f.Address, f.timeout())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackend, err)
+	}
+	return &fcgiConn{conn, bufio.NewReader(conn)}, nil
+}
+
+func (f *FastCgi) put(conn *fcgiConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.idle) >= f.Conns {
+		conn.Close()
+		return
+	}
+	f.idle = append(f.idle, conn)
+}
+
+func fcgiRecord(w io.Writer, kind uint8, content []byte) error {
+	for {
+		chunk := content
+		if len(chunk) > 65535 {
+			chunk = chunk[:65535]
+		}
+		padding := -len(chunk) & 7
+		header := []byte{1, kind, 0, 1, 0, 0, uint8(padding), 0}
+		binary.BigEndian.PutUint16(header[4:], uint16(len(chunk)))
+		_, err := w.Write(append(append(header, chunk...), make([]byte, padding)...))
+		if err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+func fcgiLength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, uint8(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+func fcgiParamsFor(env []string) []byte {
+	var params []byte
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		params = fcgiLength(params, len(k))
+		params = fcgiLength(params, len(v))
+		params = append(params, k...)
+		params = append(params, v...)
+	}
+	return params
+}
+
+func (f *FastCgi) Gate(w io.Writer, r io.Reader, env []string) error {
+	err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer f.release()
+	env = slices.Concat(env, f.Env)
+
+	// idle connections may have been closed by the backend in the meantime
+	length := Getenv(env, "CONTENT_LENGTH")
+	if length == "" || length == "0" {
+		for conn := f.pooled(); conn != nil; conn = f.pooled() {
+			t := &Tracker{Writer: w}
+			err := f.exchange(conn, t, r, env)
+			if err == nil {
+				f.put(conn)
+				return nil
+			}
+			conn.Close()
+			if t.Written > 0 || !errors.Is(err, ErrBackend) {
+				return err
+			}
+		}
+	}
+
+	conn, err := f.dial()
+	if err != nil {
+		return err
+	}
+	err = f.exchange(conn, w, r, env)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	f.put(conn)
+	return nil
+}
+
+func (f *FastCgi) exchange(conn *fcgiConn, w io.Writer, r io.Reader, env []string) error {
+	conn.SetDeadline(time.Now().Add(f.timeout()))
+	begin := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	err := fcgiRecord(conn, fcgiBeginRequest, begin)
+	if err == nil {
+		err = fcgiRecord(conn, fcgiParams, fcgiParamsFor(env))
+	}
+	if err == nil {
+		err = fcgiRecord(conn, fcgiParams, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBackend, err)
+	}
+
+	length, _ := strconv.ParseInt(Getenv(env, "CONTENT_LENGTH"), 10, 64)
+	if length > 0 && r != nil {
+		buf := make([]byte, 65535)
+		for length > 0 {
+			n, err := io.ReadFull(r, buf[:min(int64(len(buf)), length)])
+			if err != nil {
+				return fmt.Errorf("fastcgi trouble: %v", err)
+			}
+			err = fcgiRecord(conn, fcgiStdin, buf[:n])
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrBackend, err)
+			}
+			length -= int64(n)
+		}
+	}
+	err = fcgiRecord(conn, fcgiStdin, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBackend, err)
+	}
+
+	header := make([]byte, 8)
+	for {
+		conn.SetReadDeadline(time.Now().Add(f.timeout()))
+		_, err := io.ReadFull(conn.r, header)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBackend, err)
+		}
+		size := int(binary.BigEndian.Uint16(header[4:]))
+		content := make([]byte, size+int(header[6]))
+		_, err = io.ReadFull(conn.r, content)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBackend, err)
+		}
+		content = content[:size]
+
+		switch header[1] {
+		case fcgiStdout:
+			_, err = w.Write(content)
+			if err != nil {
+				return err
+			}
+		case fcgiStderr:
+			for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+				log.Printf("%s: %s", f.Address, line)
+			}
+		case fcgiEndRequest:
+			if size < 8 {
+				return fmt.Errorf("fastcgi trouble: short end request")
+			}
+			status := binary.BigEndian.Uint32(content)
+			if content[4] != 0 {
+				return fmt.Errorf("%w: request refused (%d)", ErrBackend, content[4])
+			}
+			if status != 0 {
+				return fmt.Errorf("fastcgi trouble: exit status %d", status)
+			}
+			return nil
+		}
+	}
+}
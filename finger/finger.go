@@ -0,0 +1,167 @@
+package finger
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"blekksprut.net/natto"
+)
+
+// answers queries from <user>.plan files under the root, or from a
+// <user>.cgi script when there is one
+type Hand struct {
+	Root string
+	FS   fs.FS
+	Cgi  natto.CgiRules
+}
+
+type Response struct {
+	Raw  io.Reader
+	Conn net.Conn
+}
+
+var username = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+func (h *Hand) validate(request string) (string, bool, error) {
+	if len(request) > 1024 {
+		return "", false, fmt.Errorf("too long")
+	}
+	query := strings.TrimRight(request, "\r\n")
+	verbose := false
+	if rest, ok := strings.CutPrefix(query, "/W"); ok {
+		query, verbose = strings.TrimLeft(rest, " "), true
+	}
+	if strings.Contains(query, "@") {
+		return "", false, fmt.Errorf("finger forwarding service denied")
+	}
+	if query != "" && !username.MatchString(query) {
+		return "", false, fmt.Errorf("invalid query")
+	}
+	return query, verbose, nil
+}
+
+func lines(w io.Writer, text string) error {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	_, err := io.WriteString(w, strings.ReplaceAll(text, "\n", "\r\n")+"\r\n")
+	return err
+}
+
+func (h *Hand) Handle(request string, rw io.ReadWriter) error {
+	if h.FS == nil {
+		if h.Root == "" {
+			h.Root = "."
+		}
+		h.FS = os.DirFS(h.Root)
+	}
+
+	user, verbose, err := h.validate(request)
+	if err != nil {
+		lines(rw, err.Error())
+		return err
+	}
+	if user == "" {
+		return h.list(rw)
+	}
+
+	script := user + ".cgi"
+	info, err := fs.Stat(h.FS, script)
+	if err == nil && h.Cgi.Match(script, info) {
+		env := []string{
+			"FINGER_USER=" + user,
+			"QUERY_STRING=" + strings.TrimRight(request, "\r\n"),
+			"SCRIPT_NAME=/" + script,
+		}
+		if verbose {
+			env = append(env, "FINGER_VERBOSE=1")
+		}
+		return natto.Cgi(rw, nil, filepath.Join(h.Root, script), "finger", env...)
+	}
+
+	plan, err := fs.ReadFile(h.FS, user+".plan")
+	if err != nil {
+		lines(rw, "no such user")
+		return fmt.Errorf("no such user")
+	}
+	return lines(rw, string(plan))
+}
+
+func (h *Hand) list(w io.Writer) error {
+	entries, err := fs.ReadDir(h.FS, ".")
+	if err != nil {
+		lines(w, "unreadable")
+		return err
+	}
+	var users []string
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := path.Ext(name)
+		user := strings.TrimSuffix(name, ext)
+		if entry.IsDir() || (ext != ".plan" && ext != ".cgi") || !username.MatchString(user) {
+			continue
+		}
+		if len(users) == 0 || users[len(users)-1] != user {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return lines(w, "no one here")
+	}
+	return lines(w, strings.Join(users, "\n"))
+}
+
+func (r *Response) Close() {
+	r.Conn.Close()
+}
+
+func (r *Response) Read(b []byte) (int, error) {
+	return r.Raw.Read(b)
+}
+
+// queries user@host[:port], or finger://host[:port]/user
+func Request(ctx context.Context, query string) (*Response, error) {
+	var user, host string
+	if strings.HasPrefix(query, "finger://") {
+		u, err := url.Parse(query)
+		if err != nil {
+			return nil, err
+		}
+		user, host = strings.TrimPrefix(u.Path, "/"), u.Host
+	} else {
+		i := strings.LastIndex(query, "@")
+		if i < 0 {
+			return nil, fmt.Errorf("missing host")
+		}
+		user, host = query[:i], query[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "79")
+	}
+
+	timeout, _ := time.ParseDuration("30s")
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = fmt.Fprintf(conn, "%s\r\n", user)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Response{bufio.NewReader(conn), conn}, nil
+}
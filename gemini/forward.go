@@ -0,0 +1,198 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"blekksprut.net/natto"
+	"blekksprut.net/natto/gopher"
+	"blekksprut.net/natto/spartan"
+)
+
+// Ports only apply to hosts matched by a wildcard, which can always be
+// reached on their scheme's default port
+type Forward struct {
+	Schemes []string
+	Hosts   []string
+	Ports   []int
+	Timeout time.Duration
+}
+
+var DefaultSchemes = []string{"gemini", "spartan", "gopher", "http", "https"}
+
+var defaultPorts = map[string]string{
+	"gemini": "1965", "spartan": "300", "gopher": "70", "http": "80", "https": "443",
+}
+
+// reports whether the proxy may fetch u. no Hosts refuses everything,
+// and hosts on loopback, private or link local addresses have to be
+// listed exactly rather than matched by a wildcard
+func (f *Forward) Allowed(u *url.URL) bool {
+	ok, _ := f.match(u)
+	return ok
+}
+
+// whether u is allowed, and whether its host was listed exactly. a
+// wildcard match is only checked against the address actually dialled,
+// so a name can't pass here and then resolve somewhere private
+func (f *Forward) match(u *url.URL) (bool, bool) {
+	schemes := f.Schemes
+	if schemes == nil {
+		schemes = DefaultSchemes
+	}
+	if !slices.Contains(schemes, u.Scheme) || u.Hostname() == "" {
+		return false, false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range f.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == host {
+			return true, true
+		}
+		if ok, _ := path.Match(pattern, host); !ok {
+			continue
+		}
+		if ip, err := netip.ParseAddr(host); err == nil && !natto.IsPublic(ip) {
+			return false, false
+		}
+		port := u.Port()
+		if port == "" || port == defaultPorts[u.Scheme] {
+			return true, false
+		}
+		n, err := strconv.Atoi(port)
+		return err == nil && slices.Contains(f.Ports, n), false
+	}
+	return false, false
+}
+
+func (f *Forward) Gate(w io.Writer, r io.Reader, env []string) error {
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	u, err := url.Parse(natto.Getenv(env, "GEMINI_URL"))
+	if err != nil {
+		return err
+	}
+	ok, exact := f.match(u)
+	if !ok {
+		return fmt.Errorf("%w: %s isn't allowed", natto.ErrBackend, u.Host)
+	}
+	if !exact {
+		ctx = natto.WithDialer(ctx, &net.Dialer{Control: natto.Public})
+	}
+	switch u.Scheme {
+	case "gemini":
+		return f.gemini(ctx, w, u)
+	case "spartan":
+		return f.spartan(ctx, w, u)
+	case "gopher":
+		return f.gopher(ctx, w, u)
+	case "http", "https":
+		return f.http(ctx, w, u)
+	}
+	return fmt.Errorf("unsupported scheme %s", u.Scheme)
+}
+
+func hostport(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (f *Forward) gemini(ctx context.Context, w io.Writer, u *url.URL) error {
+	res, err := fetch(ctx, u.String(), hostport(u, "1965"), u.Hostname(), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", natto.ErrBackend, err)
+	}
+	defer res.Close()
+	fmt.Fprintf(w, "%d %s\r\n", res.Status, res.Header)
+	_, err = io.Copy(w, res)
+	return err
+}
+
+func (f *Forward) spartan(ctx context.Context, w io.Writer, u *url.URL) error {
+	res, err := spartan.Request(ctx, u.String(), spartan.Data{})
+	if err != nil {
+		return fmt.Errorf("%w: %v", natto.ErrBackend, err)
+	}
+	defer res.Close()
+	meta := strings.TrimSpace(res.Header)
+	switch res.Status {
+	case spartan.Success:
+		fmt.Fprintf(w, "%d %s\r\n", Success, meta)
+		_, err = io.Copy(w, res)
+		return err
+	case spartan.ClientError:
+		fmt.Fprintf(w, "%d %s\r\n", PermanentFailure, meta)
+	default:
+		fmt.Fprintf(w, "%d %s\r\n", ProxyError, meta)
+	}
+	return nil
+}
+
+func (f *Forward) gopher(ctx context.Context, w io.Writer, u *url.URL) error {
+	res, err := gopher.Request(ctx, u.String())
+	if err != nil {
+		return fmt.Errorf("%w: %v", natto.ErrBackend, err)
+	}
+	defer res.Close()
+	fmt.Fprintf(w, "%d %s\r\n", Success, gopher.Mime(res.Type, res.Selector))
+	_, err = io.Copy(w, res)
+	return err
+}
+
+func (f *Forward) http(ctx context.Context, w io.Writer, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	dialer := natto.Dialer(ctx)
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			DisableKeepAlives:   true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", natto.ErrBackend, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode / 100 {
+	case 2:
+		fmt.Fprint(w, cgiStatus(res.StatusCode, res.Header.Get("Content-Type")))
+		_, err = io.Copy(w, res.Body)
+		return err
+	case 3:
+		loc, err := res.Location()
+		if err != nil {
+			return fmt.Errorf("%w: %v", natto.ErrBackend, err)
+		}
+		fmt.Fprint(w, cgiStatus(res.StatusCode, loc.String()))
+	case 5:
+		fmt.Fprintf(w, "%d %s\r\n", ProxyError, strings.ToLower(http.StatusText(res.StatusCode)))
+	default:
+		fmt.Fprint(w, cgiStatus(res.StatusCode, ""))
+	}
+	return nil
+}
@@ -7,12 +7,18 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"mime"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -21,10 +27,20 @@ import (
 )
 
 type Capsule struct {
-	Root string
-	FS   fs.FS
+	Root      string
+	FS        fs.FS
+	Strict    bool
+	Cgi       natto.CgiRules
+	Gateways  map[string]natto.Gateway
+	Hosts     []string
+	Forward   *Forward
+	Titan     *Titan
+	Redirects natto.Redirects
+	Index     []string
+	Listing   bool
 }
 
+// Conn is nil for responses from plain tcp backends
 type Response struct {
 	URL    *url.URL
 	Raw    io.Reader
@@ -32,47 +48,70 @@ type Response struct {
 	Status int
 	Header string
 	Cert   *x509.Certificate
+	conn   net.Conn
+	line   string
 }
 
 const (
-	Input               = 10
-	SensitiveInput      = 11
-	Success             = 20
-	TemporaryRedirect   = 30
-	PermanentRedirect   = 31
-	TemporaryFailure    = 40
-	ServerUnavailable   = 41
-	CGIError            = 42
-	ProxyError          = 43
-	SlowDown            = 44
-	PermanentFailure    = 50
-	NotFound            = 51
-	Gone                = 52
-	ProxyRequestRefused = 53
-	BadRequest          = 59
+	Input                    = 10
+	SensitiveInput           = 11
+	Success                  = 20
+	TemporaryRedirect        = 30
+	PermanentRedirect        = 31
+	TemporaryFailure         = 40
+	ServerUnavailable        = 41
+	CGIError                 = 42
+	ProxyError               = 43
+	SlowDown                 = 44
+	PermanentFailure         = 50
+	NotFound                 = 51
+	Gone                     = 52
+	ProxyRequestRefused      = 53
+	BadRequest               = 59
+	CertificateRequired      = 60
+	CertificateNotAuthorised = 61
 )
 
-func (c *Capsule) validate(request string) (string, error) {
+func (c *Capsule) validate(request string) (*url.URL, error) {
 	if len(request) > 1024 {
-		return "", fmt.Errorf("too long")
+		return nil, fmt.Errorf("too long")
 	}
 	u, err := url.Parse(strings.TrimSpace(request))
 	if err != nil {
-		return "", fmt.Errorf("invalid url")
+		return nil, fmt.Errorf("invalid url")
 	}
 	if !u.IsAbs() {
-		return "", fmt.Errorf("not an absolute url")
+		return nil, fmt.Errorf("not an absolute url")
 	}
 	if u.Fragment != "" {
-		return "", fmt.Errorf("fragments not allowed")
+		return nil, fmt.Errorf("fragments not allowed")
 	}
 	if u.User != nil {
-		return "", fmt.Errorf("userinfo not allowed")
+		return nil, fmt.Errorf("userinfo not allowed")
 	}
-	if u.Scheme != "gemini" {
-		return "", fmt.Errorf("this is a gemini server")
+	return u, nil
+}
+
+func (c *Capsule) foreign(u *url.URL) bool {
+	if u.Scheme != "gemini" && (u.Scheme != "titan" || c.Titan == nil) {
+		return true
 	}
-	return u.Path, nil
+	if len(c.Hosts) == 0 {
+		return false
+	}
+	return !slices.ContainsFunc(c.Hosts, func(host string) bool {
+		return strings.EqualFold(host, u.Hostname())
+	})
+}
+
+func (c *Capsule) forward(u *url.URL, rw io.ReadWriter) error {
+	if c.Forward == nil || !c.Forward.Allowed(u) {
+		fmt.Fprintf(rw, "%d %s\r\n", ProxyRequestRefused, "proxy request refused")
+		return fmt.Errorf("proxy request refused")
+	}
+	return c.gateway(rw, func(w io.Writer) error {
+		return c.Forward.Gate(w, nil, environ(rw, u, "", ""))
+	})
 }
 
 func (c *Capsule) Handle(request string, rw io.ReadWriter) error {
@@ -83,54 +122,250 @@ func (c *Capsule) Handle(request string, rw io.ReadWriter) error {
 		c.FS = os.DirFS(c.Root)
 	}
 
-	path, err := c.validate(request)
+	u, err := c.validate(request)
 	if err != nil {
 		fmt.Fprintf(rw, "%d %s\r\n", BadRequest, err.Error())
 		return err
 	}
-	err = c.request(path, rw)
-	if err != nil {
-		fmt.Fprintf(rw, "%d %s\r\n", NotFound, err.Error())
-		return err
+	if c.foreign(u) {
+		return c.forward(u, rw)
+	}
+	if u.Scheme == "titan" {
+		return c.upload(u, rw)
 	}
+	return c.request(u, rw)
+}
 
-	return nil
+func environ(rw io.ReadWriter, u *url.URL, script, info string) []string {
+	env := []string{
+		"GEMINI_URL=" + u.String(),
+		"SERVER_NAME=" + u.Hostname(),
+		"QUERY_STRING=" + u.RawQuery,
+		"SCRIPT_NAME=" + script,
+		"PATH_INFO=" + info,
+	}
+	if e, ok := rw.(natto.Environment); ok {
+		env = append(env, e.Environ()...)
+	}
+	return env
 }
 
-func (c *Capsule) request(path string, rw io.ReadWriter) error {
+func (c *Capsule) request(u *url.URL, rw io.ReadWriter) error {
+	path := u.Path
 	if path == "" {
 		path = "/"
 	}
-	if path[len(path)-1] == '/' {
-		path = path + "index.gmi"
+	if r, to, ok := natto.FindRedirect(c.FS, c.Redirects, path); ok {
+		switch {
+		case r.Gone:
+			fmt.Fprintf(rw, "%d %s\r\n", Gone, "gone")
+		case r.Permanent:
+			fmt.Fprintf(rw, "%d %s\r\n", PermanentRedirect, to)
+		default:
+			fmt.Fprintf(rw, "%d %s\r\n", TemporaryRedirect, to)
+		}
+		return nil
+	}
+	prefix, gateway, ok := natto.Route(c.Gateways, u.Hostname(), path)
+	if ok {
+		env := append([]string{
+			"GATEWAY_INTERFACE=CGI/1.1",
+			"SERVER_PROTOCOL=gemini",
+			"REQUEST_METHOD=GET",
+		}, environ(rw, u, prefix, strings.TrimPrefix(path, prefix))...)
+		return c.gateway(rw, func(w io.Writer) error {
+			return gateway.Gate(w, nil, env)
+		})
 	}
-	path = strings.TrimPrefix(path, "/")
 
-	mime := natto.Mime(path)
-	switch mime {
-	case "application/cgi":
-		info, err := fs.Stat(c.FS, path)
-		if err != nil {
-			fmt.Fprintf(rw, "%d %s\r\n", NotFound, err.Error())
-			return fmt.Errorf("file not found")
+	script, info, ok := c.Cgi.Find(c.FS, path)
+	if ok {
+		env := environ(rw, u, "/"+script, info)
+		return c.gateway(rw, func(w io.Writer) error {
+			return natto.Cgi(w, nil, filepath.Join(c.Root, script), "gemini", env...)
+		})
+	}
+
+	name := strings.Trim(path, "/")
+	if name == "" {
+		name = "."
+	}
+	stat, err := fs.Stat(c.FS, name)
+	if err == nil && stat.IsDir() {
+		if !strings.HasSuffix(path, "/") {
+			loc := url.URL{Path: path + "/", RawQuery: u.RawQuery}
+			fmt.Fprintf(rw, "%d %s\r\n", PermanentRedirect, loc.String())
+			return nil
 		}
-		return natto.Cgi(rw, c.Root+"/"+info.Name(), "gemini")
-	default:
-		path = strings.TrimPrefix(path, "/")
-		f, err := c.FS.Open(path)
-		if err != nil {
-			fmt.Fprintf(rw, "%d %s\r\n", NotFound, err.Error())
-			return fmt.Errorf("file not found")
+		return c.directory(u, rw, name)
+	}
+	return c.file(rw, strings.TrimPrefix(path, "/"))
+}
+
+func (c *Capsule) file(rw io.ReadWriter, name string) error {
+	mime := natto.Mime(name)
+	if mime == "application/cgi" {
+		fmt.Fprintf(rw, "%d %s\r\n", NotFound, "not found")
+		return fmt.Errorf("file not found")
+	}
+	f, err := c.FS.Open(name)
+	if err != nil {
+		fmt.Fprintf(rw, "%d %s\r\n", NotFound, err.Error())
+		return fmt.Errorf("file not found")
+	}
+	defer f.Close()
+	fmt.Fprintf(rw, "%d %s\r\n", Success, mime)
+	io.Copy(rw, f)
+	return nil
+}
+
+// serves the first index file there is, running it when it's a script,
+// or a generated listing when that's turned on
+func (c *Capsule) directory(u *url.URL, rw io.ReadWriter, dir string) error {
+	index := c.Index
+	if index == nil {
+		index = []string{"index.gmi", "index.cgi"}
+	}
+	for _, name := range index {
+		file := path.Join(dir, name)
+		info, err := fs.Stat(c.FS, file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if c.Cgi.Match(file, info) {
+			env := environ(rw, u, "/"+file, "")
+			return c.gateway(rw, func(w io.Writer) error {
+				return natto.Cgi(w, nil, filepath.Join(c.Root, file), "gemini", env...)
+			})
 		}
-		defer f.Close()
-		fmt.Fprintf(rw, "%d %s\r\n", Success, mime)
-		io.Copy(rw, f)
+		if natto.Mime(file) != "application/cgi" {
+			return c.file(rw, file)
+		}
+	}
+	if c.Listing {
+		return c.listing(rw, dir)
+	}
+	fmt.Fprintf(rw, "%d %s\r\n", NotFound, "not found")
+	return fmt.Errorf("file not found")
+}
+
+func (c *Capsule) listing(w io.Writer, dir string) error {
+	entries, err := fs.ReadDir(c.FS, dir)
+	if err != nil {
+		fmt.Fprintf(w, "%d %s\r\n", TemporaryFailure, "unreadable")
+		return err
+	}
+	title := "/"
+	if dir != "." {
+		title = "/" + dir + "/"
+	}
+	fmt.Fprintf(w, "%d %s\r\n", Success, "text/gemini")
+	fmt.Fprintf(w, "# %s\n\n", title)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		link := (&url.URL{Path: "/" + path.Join(dir, name)}).EscapedPath()
+		if entry.IsDir() {
+			name, link = name+"/", link+"/"
+		}
+		fmt.Fprintf(w, "=> %s %s\n", link, name)
 	}
 	return nil
 }
 
+func ValidHeader(line string) error {
+	status, meta, _ := strings.Cut(line, " ")
+	if len(status) != 2 {
+		return fmt.Errorf("malformed status")
+	}
+	i, err := strconv.Atoi(status)
+	if err != nil || i < 10 || i > 69 {
+		return fmt.Errorf("invalid status code %s", status)
+	}
+	if len(meta) > 1024 {
+		return fmt.Errorf("meta too long")
+	}
+	switch i / 10 {
+	case 2:
+		if meta != "" {
+			_, _, err := mime.ParseMediaType(meta)
+			if err != nil {
+				return fmt.Errorf("invalid mime type")
+			}
+		}
+	case 3:
+		_, err := url.Parse(meta)
+		if meta == "" || err != nil {
+			return fmt.Errorf("invalid redirect")
+		}
+	}
+	return nil
+}
+
+func cgiStatus(status int, meta string) string {
+	switch {
+	case status/100 == 2:
+		if meta == "" {
+			meta = "text/gemini"
+		}
+		return fmt.Sprintf("%d %s\r\n", Success, meta)
+	case status == 301 || status == 308:
+		return fmt.Sprintf("%d %s\r\n", PermanentRedirect, meta)
+	case status/100 == 3:
+		return fmt.Sprintf("%d %s\r\n", TemporaryRedirect, meta)
+	}
+	if meta == "" {
+		meta = strings.ToLower(http.StatusText(status))
+	}
+	code := CGIError
+	switch {
+	case status == 400:
+		code = BadRequest
+	case status == 404:
+		code = NotFound
+	case status == 410:
+		code = Gone
+	case status == 429:
+		code = SlowDown
+	case status == 503:
+		code = ServerUnavailable
+	case status/100 == 4:
+		code = PermanentFailure
+	}
+	return fmt.Sprintf("%d %s\r\n", code, meta)
+}
+
+func (c *Capsule) gateway(rw io.Writer, run func(io.Writer) error) error {
+	w := &natto.Tracker{Writer: rw}
+	h := &natto.Header{
+		Writer:  w,
+		Valid:   ValidHeader,
+		Failure: fmt.Sprintf("%d %s\r\n", CGIError, "invalid cgi response"),
+	}
+	var out io.Writer = w
+	if c.Strict {
+		out = h
+	}
+	t := &natto.HttpHeader{Writer: out, Format: cgiStatus}
+	err := run(t)
+	t.Close()
+	if c.Strict {
+		h.Close()
+	}
+	if err != nil && w.Written == 0 {
+		if errors.Is(err, natto.ErrBackend) {
+			fmt.Fprintf(rw, "%d %s\r\n", ProxyError, "backend unavailable")
+		} else {
+			fmt.Fprintf(rw, "%d %s\r\n", CGIError, "cgi error")
+		}
+	}
+	return err
+}
+
 func (r *Response) Close() {
-	r.Conn.Close()
+	r.conn.Close()
 }
 
 func (r *Response) Signature() [64]byte {
@@ -169,58 +404,86 @@ func doRequest(ctx context.Context, rawURL string, n int) (*Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	addr := u.Host
 	if u.Port() == "" {
-		u.Host = u.Host + ":1965"
+		addr = addr + ":1965"
 	}
-	timeout, _ := time.ParseDuration("30s")
-	nd := net.Dialer{Timeout: timeout}
-	config := tls.Config{InsecureSkipVerify: true}
-	dialer := tls.Dialer{NetDialer: &nd, Config: &config}
-
-	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	r, err := fetch(ctx, rawURL, addr, u.Hostname(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	tls := conn.(*tls.Conn)
-	state := tls.ConnectionState()
-	cert := state.PeerCertificates[0]
+	if r.Status/10 == 3 {
+		r.Close()
+		loc, err := u.Parse(r.Header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect %s", err)
+		}
+		return doRequest(ctx, loc.String(), n+1)
+	}
+	return r, nil
+}
 
-	err = cert.VerifyHostname(u.Hostname())
+// requests rawURL from addr, over tls when server names the host the
+// certificate has to be for, and over plain tcp when it's empty
+func fetch(ctx context.Context, rawURL string, addr string, server string, body io.Reader) (*Response, error) {
+	u, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, err
 	}
+	timeout, _ := time.ParseDuration("30s")
+	nd := natto.Dialer(ctx)
+	nd.Timeout = timeout
+	var conn net.Conn
+	var secure *tls.Conn
+	var cert *x509.Certificate
+	if server != "" {
+		config := tls.Config{InsecureSkipVerify: true, ServerName: server}
+		dialer := tls.Dialer{NetDialer: &nd, Config: &config}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
 
-	err = checkCertificate(cert)
-	if err != nil {
-		return nil, err
+		secure = conn.(*tls.Conn)
+		cert = secure.ConnectionState().PeerCertificates[0]
+
+		err = cert.VerifyHostname(server)
+		if err == nil {
+			err = checkCertificate(cert)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		conn, err = nd.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	fmt.Fprintf(conn, "%s\r\n", rawURL)
+	if body != nil {
+		_, err = io.Copy(conn, body)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	r := bufio.NewReader(conn)
-	header, err := r.ReadString('\n')
+	line, err := r.ReadString('\n')
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	status, header, _ := strings.Cut(header, " ")
-	if len(status) < 2 {
-		return nil, fmt.Errorf("malformed header")
-	}
-	i, err := strconv.Atoi(status)
-	if err != nil || i < 10 || i > 69 {
-		return nil, fmt.Errorf("invalid status code", status)
+	status, header, _ := strings.Cut(line, " ")
+	i, err := strconv.Atoi(strings.TrimSpace(status))
+	if err != nil || len(strings.TrimSpace(status)) != 2 || i < 10 || i > 69 {
+		conn.Close()
+		return nil, fmt.Errorf("invalid status code %s", status)
 	}
 
 	header = strings.TrimSpace(header)
-
-	if i >= 30 && i <= 40 {
-		loc, err := u.Parse(header)
-		if err != nil {
-			return nil, fmt.Errorf("invalid redirect %s", err)
-		}
-		return doRequest(ctx, loc.String(), n+1)
-	}
-	u.Host = strings.TrimSuffix(u.Host, ":1965")
-
-	return &Response{u, r, tls, i, header, cert}, nil
+	return &Response{u, r, secure, i, header, cert, conn, line}, nil
 }
@@ -0,0 +1,161 @@
+package gemini
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"blekksprut.net/natto"
+	"blekksprut.net/natto/gemtext"
+)
+
+type Mirror struct {
+	Capsule *Capsule
+}
+
+type mirrored struct {
+	io.Reader
+	io.Writer
+	env []string
+}
+
+func (m *mirrored) Environ() []string {
+	return m.env
+}
+
+var httpStatus = map[int]int{
+	TemporaryFailure:    http.StatusServiceUnavailable,
+	ServerUnavailable:   http.StatusServiceUnavailable,
+	CGIError:            http.StatusInternalServerError,
+	ProxyError:          http.StatusBadGateway,
+	SlowDown:            http.StatusTooManyRequests,
+	PermanentFailure:    http.StatusInternalServerError,
+	NotFound:            http.StatusNotFound,
+	Gone:                http.StatusGone,
+	ProxyRequestRefused: http.StatusForbidden,
+	BadRequest:          http.StatusBadRequest,
+}
+
+// links into this capsule become paths on the mirror, other links are
+// kept if gemtext.Safe allows them and dropped as "" otherwise
+func (m *Mirror) local(u *url.URL, link string) string {
+	ref, err := u.Parse(link)
+	if err != nil || !gemtext.Safe(ref.String()) {
+		return ""
+	}
+	if ref.Scheme != "gemini" || ref.Host != u.Host {
+		return ref.String()
+	}
+	ref.Scheme, ref.Host = "", ""
+	return ref.String()
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	u := &url.URL{
+		Scheme:   "gemini",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	if r.Method == http.MethodPost {
+		u.RawQuery = url.PathEscape(r.FormValue("input"))
+		http.Redirect(w, r, m.local(u, u.String()), http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	remote, port, _ := net.SplitHostPort(r.RemoteAddr)
+	env := []string{
+		"REQUEST_METHOD=" + r.Method,
+		"REQUEST_URI=" + r.URL.RequestURI(),
+		"SERVER_PROTOCOL=" + r.Proto,
+		"SERVER_SOFTWARE=natto/" + natto.Version,
+		"HTTP_HOST=" + r.Host,
+		"HTTP_USER_AGENT=" + r.UserAgent(),
+		"REMOTE_ADDR=" + remote,
+		"REMOTE_PORT=" + port,
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		rw := &mirrored{strings.NewReader(""), pw, env}
+		pw.CloseWithError(m.Capsule.Handle(u.String(), rw))
+	}()
+	defer pr.Close()
+
+	br := bufio.NewReader(pr)
+	line, _ := br.ReadString('\n')
+	if line == "" {
+		http.Error(w, "no response", http.StatusBadGateway)
+		return
+	}
+	status, meta, _ := strings.Cut(strings.TrimSpace(line), " ")
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		http.Error(w, "invalid response", http.StatusBadGateway)
+		return
+	}
+
+	switch code / 10 {
+	case 1:
+		kind := "text"
+		if code == SensitiveInput {
+			kind = "password"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!doctype html>\n<meta charset=\"utf-8\">\n<title>%s</title>\n"+
+			"<form method=\"post\"><label>%s <input type=\"%s\" name=\"input\" autofocus>"+
+			"</label><button>send</button></form>\n",
+			html.EscapeString(meta), html.EscapeString(meta), kind)
+	case 2:
+		if meta == "" {
+			meta = "text/gemini"
+		}
+		kind, _, _ := mime.ParseMediaType(meta)
+		if kind != "text/gemini" {
+			w.Header().Set("Content-Type", meta)
+			io.Copy(w, br)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!doctype html>\n<meta charset=\"utf-8\">\n<title>%s</title>\n",
+			html.EscapeString(u.Path))
+		gemtext.HTML(w, br, func(link string) string {
+			return m.local(u, link)
+		})
+	case 3:
+		status := http.StatusFound
+		if code == PermanentRedirect {
+			status = http.StatusMovedPermanently
+		}
+		to := m.local(u, meta)
+		if to == "" {
+			http.Error(w, "invalid redirect", http.StatusBadGateway)
+			return
+		}
+		http.Redirect(w, r, to, status)
+	case 6:
+		http.Error(w, meta, http.StatusForbidden)
+	default:
+		status, ok := httpStatus[code]
+		if !ok {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, meta, status)
+	}
+}
@@ -0,0 +1,69 @@
+package gemini
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"blekksprut.net/natto"
+)
+
+// passes requests on to another capsule. with TLS, the backend's
+// certificate has to be for ServerName, or for the Backend's host. that
+// name is all that's checked, as capsules sign their own certificates,
+// unless Fingerprint pins the certificate too, as a sha256 fingerprint
+// in hex like the ones titan checks
+type Proxy struct {
+	Backend     string
+	TLS         bool
+	ServerName  string
+	Fingerprint string
+	Timeout     time.Duration
+}
+
+func pinned(cert *x509.Certificate, fingerprint string) bool {
+	sum := sha256.Sum256(cert.Raw)
+	return strings.EqualFold(hex.EncodeToString(sum[:]), fingerprint)
+}
+
+func (p *Proxy) Gate(w io.Writer, r io.Reader, env []string) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	server := ""
+	if p.TLS {
+		server = p.ServerName
+		if server == "" {
+			server = p.Backend
+			if host, _, err := net.SplitHostPort(p.Backend); err == nil {
+				server = host
+			}
+		}
+	}
+	res, err := fetch(ctx, natto.Getenv(env, "GEMINI_URL"), p.Backend, server, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", natto.ErrBackend, err)
+	}
+	defer res.Close()
+	if p.Fingerprint != "" && (res.Cert == nil || !pinned(res.Cert, p.Fingerprint)) {
+		return fmt.Errorf("%w: certificate doesn't match the pinned fingerprint", natto.ErrBackend)
+	}
+
+	// the header goes back as the backend sent it
+	_, err = io.WriteString(w, res.line)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, res)
+	return err
+}
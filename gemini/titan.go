@@ -0,0 +1,183 @@
+package gemini
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"blekksprut.net/natto"
+)
+
+// accepts titan uploads from anyone holding one of the tokens or one of
+// the client certificates (sha256 fingerprints in hex)
+type Titan struct {
+	Tokens  []string
+	Certs   []string
+	MaxSize int64
+}
+
+type upload struct {
+	path  string
+	size  int64
+	mime  string
+	token string
+}
+
+func (t *Titan) maxSize() int64 {
+	if t.MaxSize == 0 {
+		return 16 << 20
+	}
+	return t.MaxSize
+}
+
+func fingerprint(rw io.ReadWriter) string {
+	peer, ok := rw.(natto.Peer)
+	if !ok || peer.Certificate() == nil {
+		return ""
+	}
+	sum := sha256.Sum256(peer.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *Titan) authorized(token, fingerprint string) bool {
+	if token != "" && slices.Contains(t.Tokens, token) {
+		return true
+	}
+	return fingerprint != "" && slices.ContainsFunc(t.Certs, func(cert string) bool {
+		return strings.EqualFold(cert, fingerprint)
+	})
+}
+
+func parseUpload(u *url.URL) (*upload, error) {
+	p, params, _ := strings.Cut(u.Path, ";")
+	up := &upload{path: p, size: -1, mime: "text/gemini"}
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid size")
+			}
+			up.size = size
+		case "mime":
+			_, _, err := mime.ParseMediaType(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mime type")
+			}
+			up.mime = value
+		case "token":
+			up.token = value
+		}
+	}
+	if up.size < 0 {
+		return nil, fmt.Errorf("missing size")
+	}
+	if up.path == "" {
+		up.path = "/"
+	}
+	return up, nil
+}
+
+func (c *Capsule) upload(u *url.URL, rw io.ReadWriter) error {
+	up, err := parseUpload(u)
+	if err != nil {
+		fmt.Fprintf(rw, "%d %s\r\n", BadRequest, err.Error())
+		return err
+	}
+	if up.size > c.Titan.maxSize() {
+		fmt.Fprintf(rw, "%d %s\r\n", BadRequest, "upload too large")
+		return fmt.Errorf("upload too large")
+	}
+	hash := fingerprint(rw)
+	if !c.Titan.authorized(up.token, hash) {
+		if hash != "" {
+			fmt.Fprintf(rw, "%d %s\r\n", CertificateNotAuthorised, "certificate not authorised")
+		} else {
+			fmt.Fprintf(rw, "%d %s\r\n", CertificateRequired, "token or client certificate required")
+		}
+		return fmt.Errorf("unauthorised upload")
+	}
+	body := io.LimitReader(rw, up.size)
+
+	target := *u
+	target.Scheme, target.Path, target.RawPath = "gemini", up.path, ""
+	script, info, ok := c.Cgi.Find(c.FS, up.path)
+	if ok {
+		env := append(environ(rw, &target, "/"+script, info),
+			"REQUEST_METHOD=POST",
+			"CONTENT_LENGTH="+strconv.FormatInt(up.size, 10),
+			"CONTENT_TYPE="+up.mime,
+			"TITAN_URL="+u.String(),
+			"TITAN_TOKEN="+up.token,
+			"TLS_CLIENT_HASH="+hash,
+		)
+		return c.gateway(rw, func(w io.Writer) error {
+			return natto.Cgi(w, body, filepath.Join(c.Root, script), "titan", env...)
+		})
+	}
+
+	name := path.Clean(up.path)
+	if strings.HasSuffix(up.path, "/") {
+		name = path.Join(name, "index.gmi")
+	}
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || natto.Hidden(name) || c.Cgi.Covers(name) {
+		fmt.Fprintf(rw, "%d %s\r\n", PermanentFailure, "not writable")
+		return fmt.Errorf("not writable")
+	}
+
+	if up.size == 0 {
+		err = os.Remove(filepath.Join(c.Root, filepath.FromSlash(name)))
+	} else {
+		err = natto.WriteFile(c.Root, name, body, up.size)
+	}
+	if err != nil {
+		fmt.Fprintf(rw, "%d %s\r\n", TemporaryFailure, "upload failed")
+		return err
+	}
+	fmt.Fprintf(rw, "%d %s\r\n", TemporaryRedirect, target.String())
+	return nil
+}
+
+// uploads size bytes from r to a titan (or gemini) url, following the
+// redirect the server answers with
+func Upload(ctx context.Context, rawURL, mime, token string, r io.Reader, size int64) (*Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = "titan"
+	u.Path += ";size=" + strconv.FormatInt(size, 10)
+	if mime != "" {
+		u.Path += ";mime=" + mime
+	}
+	if token != "" {
+		u.Path += ";token=" + token
+	}
+	u.RawPath = ""
+
+	res, err := fetch(ctx, u.String(), hostport(u, "1965"), u.Hostname(), io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
+	}
+	if res.Status/10 == 3 {
+		res.Close()
+		loc, err := u.Parse(res.Header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect %s", err)
+		}
+		return doRequest(ctx, loc.String(), 1)
+	}
+	return res, nil
+}
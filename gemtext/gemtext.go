@@ -0,0 +1,157 @@
+package gemtext
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// the schemes a rendered link may use. anything else, javascript: and
+// data: included, is shown as plain text
+var Schemes = []string{"gemini", "spartan", "http", "https", "gopher"}
+
+// reports whether link is relative or uses one of Schemes
+func Safe(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "" || slices.Contains(Schemes, u.Scheme))
+}
+
+type Line struct {
+	Kind  string
+	Text  string
+	URL   string
+	Label string
+}
+
+func Parse(r io.Reader) ([]Line, error) {
+	var lines []Line
+	pre := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(text, "```") {
+			pre = !pre
+			lines = append(lines, Line{Kind: "```", Text: text[3:]})
+			continue
+		}
+		if pre {
+			lines = append(lines, Line{Kind: "pre", Text: text})
+			continue
+		}
+		lines = append(lines, parse(text))
+	}
+	return lines, scanner.Err()
+}
+
+func parse(text string) Line {
+	for _, kind := range []string{"=>", "=:"} {
+		if rest, ok := strings.CutPrefix(text, kind); ok {
+			fields := strings.Fields(rest)
+			if len(fields) == 0 {
+				return Line{Kind: "text", Text: text}
+			}
+			label := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), fields[0]))
+			return Line{Kind: kind, URL: fields[0], Label: label}
+		}
+	}
+	for _, kind := range []string{"###", "##", "#", "* ", ">"} {
+		if rest, ok := strings.CutPrefix(text, kind); ok {
+			return Line{Kind: strings.TrimSpace(kind), Text: strings.TrimSpace(rest)}
+		}
+	}
+	return Line{Kind: "text", Text: text}
+}
+
+// renders gemtext as html, passing every link through link first. links
+// it returns as "", or that aren't Safe, lose their href
+func HTML(w io.Writer, r io.Reader, link func(string) string) error {
+	lines, err := Parse(r)
+	if err != nil {
+		return err
+	}
+	if link == nil {
+		link = func(u string) string { return u }
+	}
+	list, pre := false, false
+	for _, line := range lines {
+		if list && line.Kind != "*" {
+			fmt.Fprintln(w, "</ul>")
+			list = false
+		}
+		text := html.EscapeString(line.Text)
+		href := ""
+		if line.Kind == "=>" || line.Kind == "=:" {
+			href = link(line.URL)
+			if !Safe(href) {
+				href = ""
+			}
+		}
+		switch line.Kind {
+		case "```":
+			pre = !pre
+			if pre {
+				fmt.Fprintf(w, "<pre title=\"%s\">", text)
+			} else {
+				fmt.Fprintln(w, "</pre>")
+			}
+		case "pre":
+			fmt.Fprintln(w, text)
+		case "=>":
+			label := line.Label
+			if label == "" {
+				label = line.URL
+			}
+			if href == "" {
+				fmt.Fprintf(w, "<p class=\"link\">%s</p>\n", html.EscapeString(label))
+				continue
+			}
+			fmt.Fprintf(w, "<p class=\"link\"><a href=\"%s\">%s</a></p>\n",
+				html.EscapeString(href), html.EscapeString(label))
+		case "=:":
+			label := line.Label
+			if label == "" {
+				label = line.URL
+			}
+			if href == "" {
+				fmt.Fprintf(w, "<p class=\"prompt\">%s</p>\n", html.EscapeString(label))
+				continue
+			}
+			fmt.Fprintf(w, "<form class=\"prompt\" method=\"post\" action=\"%s\">"+
+				"<label>%s <textarea name=\"data\"></textarea></label>"+
+				"<button>send</button></form>\n",
+				html.EscapeString(href), html.EscapeString(label))
+		case "#":
+			fmt.Fprintf(w, "<h1>%s</h1>\n", text)
+		case "##":
+			fmt.Fprintf(w, "<h2>%s</h2>\n", text)
+		case "###":
+			fmt.Fprintf(w, "<h3>%s</h3>\n", text)
+		case "*":
+			if !list {
+				fmt.Fprintln(w, "<ul>")
+				list = true
+			}
+			fmt.Fprintf(w, "<li>%s</li>\n", text)
+		case ">":
+			fmt.Fprintf(w, "<blockquote>%s</blockquote>\n", text)
+		default:
+			if text == "" {
+				fmt.Fprintln(w, "<br>")
+			} else {
+				fmt.Fprintf(w, "<p>%s</p>\n", text)
+			}
+		}
+	}
+	if list {
+		fmt.Fprintln(w, "</ul>")
+	}
+	if pre {
+		fmt.Fprintln(w, "</pre>")
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package gopher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"blekksprut.net/natto"
+)
+
+const (
+	Text      = '0'
+	Menu      = '1'
+	Error     = '3'
+	Binary    = '9'
+	Search    = '7'
+	Gif       = 'g'
+	Image     = 'I'
+	Html      = 'h'
+	Info      = 'i'
+	Terminate = ".\r\n"
+)
+
+type Hole struct {
+	Root string
+	FS   fs.FS
+	Cgi  natto.CgiRules
+	Host string
+	Port string
+}
+
+type Response struct {
+	URL      *url.URL
+	Raw      io.Reader
+	Conn     net.Conn
+	Type     byte
+	Selector string
+}
+
+func (h *Hole) host() (string, string) {
+	host, port := h.Host, h.Port
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "70"
+	}
+	return host, port
+}
+
+func (h *Hole) item(w io.Writer, kind byte, display, selector string) {
+	host, port := h.host()
+	fmt.Fprintf(w, "%c%s\t%s\t%s\t%s\r\n", kind, display, selector, host, port)
+}
+
+func (h *Hole) failure(w io.Writer, msg string) {
+	fmt.Fprintf(w, "%c%s\t\terror.host\t1\r\n%s", Error, msg, Terminate)
+}
+
+// item type for a file, judged by its extension
+func Kind(name string) byte {
+	mime := natto.Mime(name)
+	switch {
+	case mime == "application/cgi":
+		return Text
+	case mime == "image/gif":
+		return Gif
+	case mime == "text/html":
+		return Html
+	case strings.HasPrefix(mime, "text/"):
+		return Text
+	case strings.HasPrefix(mime, "image/"):
+		return Image
+	}
+	return Binary
+}
+
+// mime type for an item type, for relaying gopher content elsewhere
+func Mime(kind byte, selector string) string {
+	switch kind {
+	case Text, Menu, Search:
+		return "text/plain"
+	case Html:
+		return "text/html"
+	case Gif:
+		return "image/gif"
+	case Image:
+		return natto.Mime(selector)
+	}
+	return "application/octet-stream"
+}
+
+func (h *Hole) validate(request string) (string, string, error) {
+	if len(request) > 1024 {
+		return "", "", fmt.Errorf("too long")
+	}
+	selector, search, _ := strings.Cut(strings.TrimRight(request, "\r\n"), "\t")
+	if strings.ContainsAny(selector, "\r\n") {
+		return "", "", fmt.Errorf("invalid selector")
+	}
+	for _, segment := range strings.Split(selector, "/") {
+		if segment == ".." {
+			return "", "", fmt.Errorf("invalid selector")
+		}
+	}
+	return "/" + strings.TrimPrefix(selector, "/"), search, nil
+}
+
+func (h *Hole) Handle(request string, rw io.ReadWriter) error {
+	if h.FS == nil {
+		if h.Root == "" {
+			h.Root = "."
+		}
+		h.FS = os.DirFS(h.Root)
+	}
+
+	selector, search, err := h.validate(request)
+	if err != nil {
+		h.failure(rw, err.Error())
+		return err
+	}
+
+	script, info, ok := h.Cgi.Find(h.FS, selector)
+	if ok {
+		host, port := h.host()
+		return natto.Cgi(rw, nil, filepath.Join(h.Root, script), "gopher",
+			"SELECTOR="+selector,
+			"QUERY_STRING="+search,
+			"SERVER_NAME="+host,
+			"SERVER_PORT="+port,
+			"SCRIPT_NAME=/"+script,
+			"PATH_INFO="+info,
+		)
+	}
+
+	name := strings.Trim(selector, "/")
+	if name == "" {
+		name = "."
+	}
+	stat, err := fs.Stat(h.FS, name)
+	if err != nil {
+		h.failure(rw, "not found")
+		return fmt.Errorf("file not found")
+	}
+	if stat.IsDir() {
+		return h.menu(rw, name)
+	}
+	if natto.Mime(name) == "application/cgi" {
+		h.failure(rw, "not found")
+		return fmt.Errorf("file not found")
+	}
+	f, err := h.FS.Open(name)
+	if err != nil {
+		h.failure(rw, "unreadable")
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(rw, f)
+	return err
+}
+
+func (h *Hole) menu(w io.Writer, dir string) error {
+	f, err := h.FS.Open(path.Join(dir, "gophermap"))
+	if err == nil {
+		defer f.Close()
+		return h.gophermap(w, dir, f)
+	}
+
+	entries, err := fs.ReadDir(h.FS, dir)
+	if err != nil {
+		h.failure(w, "unreadable")
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || name == "gophermap" {
+			continue
+		}
+		selector := "/" + path.Join(dir, name)
+		switch {
+		case entry.IsDir():
+			h.item(w, Menu, name+"/", selector+"/")
+		default:
+			h.item(w, Kind(name), name, selector)
+		}
+	}
+	_, err = io.WriteString(w, Terminate)
+	return err
+}
+
+// lines with tabs are menu items, with missing fields filled in and
+// relative selectors resolved against the directory. the rest is info
+func (h *Hole) gophermap(w io.Writer, dir string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "." {
+			break
+		}
+		if !strings.Contains(line, "\t") || line[0] == '\t' {
+			h.item(w, Info, line, "")
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		kind, display := line[0], fields[0][1:]
+		selector := fields[1]
+		if selector == "" {
+			selector = display
+		}
+		// items on other hosts keep their selector, and port 70 unless given
+		if len(fields) >= 3 && fields[2] != "" {
+			port := "70"
+			if len(fields) >= 4 && fields[3] != "" {
+				port = fields[3]
+			}
+			fmt.Fprintf(w, "%c%s\t%s\t%s\t%s\r\n", kind, display, selector, fields[2], port)
+			continue
+		}
+		if !strings.HasPrefix(selector, "/") && !strings.Contains(selector, ":") {
+			selector = "/" + path.Join(dir, selector)
+		}
+		h.item(w, kind, display, selector)
+	}
+	_, err := io.WriteString(w, Terminate)
+	if err == nil {
+		err = scanner.Err()
+	}
+	return err
+}
+
+func (r *Response) Close() {
+	r.Conn.Close()
+}
+
+func (r *Response) Read(b []byte) (int, error) {
+	return r.Raw.Read(b)
+}
+
+// fetches gopher://host[:port]/<type><selector>[%09search]
+func Request(ctx context.Context, rawURL string) (*Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "70")
+	}
+
+	kind, selector := byte(Menu), ""
+	p, _ := url.PathUnescape(u.EscapedPath())
+	if len(p) > 1 {
+		kind, selector = p[1], p[2:]
+	}
+	if u.RawQuery != "" {
+		selector += "\t" + u.RawQuery
+	}
+
+	timeout, _ := time.ParseDuration("30s")
+	dialer := natto.Dialer(ctx)
+	dialer.Timeout = timeout
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = fmt.Fprintf(conn, "%s\r\n", selector)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	_, err = r.Peek(1)
+	if err != nil && err != io.EOF {
+		conn.Close()
+		return nil, err
+	}
+	return &Response{u, r, conn, kind, selector}, nil
+}
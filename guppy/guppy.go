@@ -0,0 +1,344 @@
+package guppy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blekksprut.net/natto"
+)
+
+const (
+	Input    = 1
+	Success  = 2 // never on the wire, content starts with a sequence number
+	Redirect = 3
+	Error    = 4
+)
+
+// serves a gemini capsule's content over guppy. responses are split
+// into chunks, each sent until acknowledged or out of retries. since the
+// source of a datagram is easily forged, only the first chunk goes out
+// until it's acknowledged, and requests past MaxSessions are dropped
+type Tank struct {
+	Capsule     natto.Capsule
+	ChunkSize   int
+	Window      int
+	Timeout     time.Duration
+	Retries     int
+	MaxSessions int
+	mu          sync.Mutex
+	sessions    map[string]chan int
+}
+
+type Response struct {
+	URL    *url.URL
+	Status int
+	Header string
+	Body   []byte
+}
+
+func (t *Tank) chunkSize() int {
+	if t.ChunkSize == 0 {
+		return 1024
+	}
+	return t.ChunkSize
+}
+
+func (t *Tank) window() int {
+	if t.Window == 0 {
+		return 8
+	}
+	return t.Window
+}
+
+func (t *Tank) timeout() time.Duration {
+	if t.Timeout == 0 {
+		return 2 * time.Second
+	}
+	return t.Timeout
+}
+
+func (t *Tank) retries() int {
+	if t.Retries == 0 {
+		return 5
+	}
+	return t.Retries
+}
+
+func (t *Tank) maxSessions() int {
+	if t.MaxSessions == 0 {
+		return 64
+	}
+	return t.MaxSessions
+}
+
+func ack(packet []byte) (int, bool) {
+	line, ok := bytes.CutSuffix(packet, []byte("\r\n"))
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(string(line))
+	return seq, err == nil
+}
+
+func (t *Tank) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		packet := bytes.Clone(buf[:n])
+		if seq, ok := ack(packet); ok {
+			t.mu.Lock()
+			acks := t.sessions[addr.String()]
+			t.mu.Unlock()
+			if acks != nil {
+				select {
+				case acks <- seq:
+				default:
+				}
+			}
+			continue
+		}
+
+		t.mu.Lock()
+		if t.sessions == nil {
+			t.sessions = map[string]chan int{}
+		}
+		_, busy := t.sessions[addr.String()]
+		busy = busy || len(t.sessions) >= t.maxSessions()
+		acks := make(chan int, 64)
+		if !busy {
+			t.sessions[addr.String()] = acks
+		}
+		t.mu.Unlock()
+		if busy {
+			continue
+		}
+		go func() {
+			defer func() {
+				t.mu.Lock()
+				delete(t.sessions, addr.String())
+				t.mu.Unlock()
+			}()
+			t.respond(conn, addr, string(packet), acks)
+		}()
+	}
+}
+
+// runs the request against the capsule, turning the gemini response
+// into guppy packets
+func (t *Tank) packets(request string) [][]byte {
+	u, err := url.Parse(strings.TrimSpace(request))
+	if err != nil || u.Scheme != "guppy" || !strings.HasSuffix(request, "\r\n") {
+		return [][]byte{fmt.Appendf(nil, "%d %s\r\n", Error, "invalid request")}
+	}
+	host := u.Host
+	u.Scheme, u.Host = "gemini", u.Hostname()
+
+	var buf bytes.Buffer
+	t.Capsule.Handle(u.String(), &struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(""), &buf})
+	line, _ := buf.ReadString('\n')
+	status, meta, _ := strings.Cut(strings.TrimSpace(line), " ")
+	code, _ := strconv.Atoi(status)
+
+	switch code / 10 {
+	case 1:
+		return [][]byte{fmt.Appendf(nil, "%d %s\r\n", Input, meta)}
+	case 2:
+	case 3:
+		loc, err := u.Parse(meta)
+		if err == nil && loc.Scheme == "gemini" && loc.Host == u.Host {
+			loc.Scheme, loc.Host = "guppy", host
+			meta = loc.String()
+		}
+		return [][]byte{fmt.Appendf(nil, "%d %s\r\n", Redirect, meta)}
+	default:
+		if meta == "" {
+			meta = "error"
+		}
+		return [][]byte{fmt.Appendf(nil, "%d %s\r\n", Error, meta)}
+	}
+
+	if meta == "" {
+		meta = "text/gemini"
+	}
+	seq := 6 + rand.IntN(1<<30)
+	body := buf.Bytes()
+	packets := [][]byte{}
+	for first := true; first || len(body) > 0; first = false {
+		chunk := body[:min(len(body), t.chunkSize())]
+		body = body[len(chunk):]
+		header := fmt.Appendf(nil, "%d\r\n", seq)
+		if first {
+			header = fmt.Appendf(nil, "%d %s\r\n", seq, meta)
+		}
+		packets = append(packets, append(header, chunk...))
+		seq++
+	}
+	return append(packets, fmt.Appendf(nil, "%d\r\n", seq))
+}
+
+func (t *Tank) respond(conn net.PacketConn, addr net.Addr, request string, acks chan int) {
+	packets := t.packets(request)
+	if len(packets) == 1 {
+		conn.WriteTo(packets[0], addr)
+		return
+	}
+
+	first, _ := strconv.Atoi(string(bytes.Fields(packets[0])[0]))
+	acked := make([]bool, len(packets))
+	sent := make([]time.Time, len(packets))
+	tries := make([]int, len(packets))
+	base := 0
+	for base < len(packets) {
+		// the window opens once the client has shown it asked
+		window := 1
+		if base > 0 {
+			window = t.window()
+		}
+		now := time.Now()
+		for i := base; i < min(base+window, len(packets)); i++ {
+			if acked[i] || (!sent[i].IsZero() && now.Sub(sent[i]) < t.timeout()) {
+				continue
+			}
+			if tries[i] == t.retries() {
+				return
+			}
+			conn.WriteTo(packets[i], addr)
+			sent[i] = now
+			tries[i]++
+		}
+		select {
+		case seq := <-acks:
+			if i := seq - first; i >= 0 && i < len(packets) {
+				acked[i] = true
+			}
+			for base < len(packets) && acked[base] {
+				base++
+			}
+		case <-time.After(t.timeout() / 4):
+		}
+	}
+}
+
+func Request(ctx context.Context, rawURL string) (*Response, error) {
+	return request(ctx, rawURL, 0)
+}
+
+func request(ctx context.Context, rawURL string, n int) (*Response, error) {
+	if n > 5 {
+		return nil, fmt.Errorf("too many redirects")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6775")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	res := &Response{URL: u}
+	chunks := map[int][]byte{}
+	start, end := -1, -1
+	buf := make([]byte, 65536)
+	conn.Write([]byte(rawURL + "\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for tries := 1; ; {
+		size, err := conn.Read(buf)
+		if isTimeout(err) && start < 0 && tries < 5 && time.Now().Before(deadline) {
+			conn.Write([]byte(rawURL + "\r\n"))
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			tries++
+			continue
+		}
+		if isTimeout(err) {
+			return nil, fmt.Errorf("timed out")
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, data, ok := bytes.Cut(buf[:size], []byte("\r\n"))
+		if !ok {
+			return nil, fmt.Errorf("malformed packet")
+		}
+		first, meta, _ := strings.Cut(string(line), " ")
+		seq, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("malformed packet")
+		}
+
+		switch {
+		case seq == Redirect:
+			loc, err := u.Parse(meta)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redirect %s", err)
+			}
+			return request(ctx, loc.String(), n+1)
+		case seq == Input || seq == Error:
+			res.Status, res.Header = seq, meta
+			return res, nil
+		case seq < 6:
+			return nil, fmt.Errorf("invalid status %d", seq)
+		}
+
+		fmt.Fprintf(conn, "%d\r\n", seq)
+		if meta != "" {
+			start, res.Status, res.Header = seq, Success, meta
+			conn.SetReadDeadline(deadline)
+		}
+		if len(data) == 0 && meta == "" {
+			end = seq
+		}
+		if _, ok := chunks[seq]; !ok {
+			chunks[seq] = bytes.Clone(data)
+		}
+		if start < 0 || end < 0 {
+			continue
+		}
+		complete := true
+		for i := start; i < end && complete; i++ {
+			_, complete = chunks[i]
+		}
+		if complete {
+			for i := start; i < end; i++ {
+				res.Body = append(res.Body, chunks[i]...)
+			}
+			return res, nil
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
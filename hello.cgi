@@ -1,5 +1,4 @@
 #!/bin/sh
 
-echo "20 text/plain\r\n"
+printf "20 text/plain\r\n"
 echo "hello world"
-
@@ -0,0 +1,223 @@
+package natto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccomp filters survive execve, so a server that locked itself down
+// would hand its filter to every script it runs. the launcher is a copy
+// of the server started before the lockdown, which runs scripts for it
+const launcherEnv = "NATTO_CGI_LAUNCHER"
+
+// the server's end of the launcher's socket, nil without a launcher
+var launcher *os.File
+
+type launch struct {
+	Path string
+	Args []string
+	Dir  string
+	Env  []string
+}
+
+// starts the launcher, for servers to call before seccomp.Pledge. cgi
+// scripts then run outside the filter, and the server needs no exec or
+// proc promises
+func StartLauncher() error {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "launcher"), os.NewFile(uintptr(fds[1]), "launcher")
+	defer theirs.Close()
+	cmd := exec.Command(self)
+	cmd.Env = append(os.Environ(), launcherEnv+"=1")
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		ours.Close()
+		return err
+	}
+	launcher = ours
+	return nil
+}
+
+// the launcher's side: one message per script, carrying a session
+// socket and the script's stdin, stdout and stderr. exits with the server
+func launches() {
+	if _, ok := os.LookupEnv(launcherEnv); !ok {
+		return
+	}
+	os.Unsetenv(launcherEnv)
+	buf := make([]byte, 1<<20)
+	oob := make([]byte, unix.CmsgSpace(4*4))
+	for {
+		n, oobn, _, _, err := unix.Recvmsg(3, buf, oob, unix.MSG_CMSG_CLOEXEC)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || n == 0 {
+			os.Exit(0)
+		}
+		var fds []int
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err == nil && len(msgs) == 1 {
+			fds, _ = unix.ParseUnixRights(&msgs[0])
+		}
+		if len(fds) != 4 {
+			for _, fd := range fds {
+				unix.Close(fd)
+			}
+			continue
+		}
+		var l launch
+		err = json.Unmarshal(buf[:n], &l)
+		go l.run(err, fds)
+	}
+}
+
+func (l *launch) run(err error, fds []int) {
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		files[i] = os.NewFile(uintptr(fd), "launch")
+	}
+	session := files[0]
+	defer session.Close()
+	cmd := &exec.Cmd{Path: l.Path, Args: l.Args, Dir: l.Dir, Env: l.Env}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = files[1], files[2], files[3]
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err == nil {
+		err = cmd.Start()
+	}
+	for _, f := range files[1:] {
+		f.Close()
+	}
+	if err != nil {
+		io.WriteString(session, err.Error())
+		return
+	}
+
+	// the server hanging up early means the script timed out
+	var mu sync.Mutex
+	done := false
+	go func() {
+		io.Copy(io.Discard, session)
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}()
+	err = cmd.Wait()
+	mu.Lock()
+	done = true
+	mu.Unlock()
+	if err != nil {
+		io.WriteString(session, err.Error())
+	}
+	// closing wouldn't do while the reader above holds the socket
+	unix.Shutdown(fds[0], unix.SHUT_WR)
+}
+
+// runs cmd through the launcher when there is one, killing it once ctx
+// is done
+func start(ctx context.Context, cmd *exec.Cmd) error {
+	if launcher == nil || cmd.Err != nil {
+		return local(cmd)
+	}
+	req, err := json.Marshal(launch{cmd.Path, cmd.Args, cmd.Dir, cmd.Env})
+	if err != nil {
+		return err
+	}
+	pair, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	session, theirs := os.NewFile(uintptr(pair[0]), "session"), os.NewFile(uintptr(pair[1]), "session")
+	defer session.Close()
+	var ends [6]*os.File
+	for i := 0; i < len(ends); i += 2 {
+		ends[i], ends[i+1], err = os.Pipe()
+		if err != nil {
+			theirs.Close()
+			for _, f := range ends[:i] {
+				f.Close()
+			}
+			return err
+		}
+	}
+	stdin, stdout, stderr := ends[1], ends[2], ends[4]
+	rights := unix.UnixRights(int(theirs.Fd()), int(ends[0].Fd()), int(ends[3].Fd()), int(ends[5].Fd()))
+	err = unix.Sendmsg(int(launcher.Fd()), req, rights, nil, 0)
+	for _, f := range []*os.File{theirs, ends[0], ends[3], ends[5]} {
+		f.Close()
+	}
+	if err != nil {
+		stdin.Close()
+		stdout.Close()
+		stderr.Close()
+		return fmt.Errorf("launcher trouble: %v", err)
+	}
+
+	go func() {
+		if cmd.Stdin != nil {
+			io.Copy(stdin, cmd.Stdin)
+		}
+		stdin.Close()
+	}()
+	var copies sync.WaitGroup
+	for out, w := range map[*os.File]io.Writer{stdout: cmd.Stdout, stderr: cmd.Stderr} {
+		copies.Add(1)
+		go func() {
+			defer copies.Done()
+			if w == nil {
+				w = io.Discard
+			}
+			io.Copy(w, out)
+		}()
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		msg, _ := io.ReadAll(session)
+		result <- string(msg)
+	}()
+	var msg string
+	select {
+	case msg = <-result:
+	case <-ctx.Done():
+		unix.Shutdown(int(session.Fd()), unix.SHUT_RDWR)
+		msg = <-result
+	}
+
+	// like exec.Cmd's WaitDelay, for whatever still holds the pipes
+	copied := make(chan struct{})
+	go func() {
+		copies.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+		stdout.Close()
+		stderr.Close()
+		<-copied
+	}
+	stdout.Close()
+	stderr.Close()
+	if msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package misfin
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"blekksprut.net/natto"
+)
+
+const (
+	Success             = 20
+	TemporaryFailure    = 40
+	MailboxFull         = 42
+	PermanentFailure    = 50
+	MailboxNotFound     = 51
+	DomainNotServiced   = 53
+	BadRequest          = 59
+	CertificateRequired = 60
+	UnauthorisedSender  = 61
+	CertificateNotValid = 62
+)
+
+var mailboxName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// accepts mail for <mailbox>.gmi files under the root, appending each
+// message as gemtext. senders are identified by their client certificate,
+// which must be signed by (or be) the certificate of their own mailserver.
+// Lookup fetches that certificate, defaulting to ServerCertificate
+type Postbox struct {
+	Root        string
+	Hosts       []string
+	Senders     []string
+	Fingerprint string
+	MaxSize     int
+	Lookup      func(ctx context.Context, host string) (*x509.Certificate, error)
+	mu          sync.Mutex
+}
+
+type Response struct {
+	Status int
+	Header string
+	Cert   *x509.Certificate
+}
+
+// the address (uid@host) and display name a certificate claims
+func Identity(cert *x509.Certificate) (string, string, error) {
+	var uid string
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}) {
+			uid, _ = name.Value.(string)
+		}
+	}
+	if uid == "" || len(cert.DNSNames) == 0 {
+		return "", "", fmt.Errorf("certificate lacks a mailbox or hostname")
+	}
+	if strings.ContainsFunc(uid+cert.DNSNames[0], unicode.IsSpace) || strings.ContainsAny(cert.DNSNames[0], ":/@") {
+		return "", "", fmt.Errorf("invalid address")
+	}
+	return uid + "@" + cert.DNSNames[0], cert.Subject.CommonName, nil
+}
+
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// the certificate the mailserver for host presents on port 1958. only
+// public addresses are dialled, as host comes from a stranger's cert
+func ServerCertificate(ctx context.Context, host string) (*x509.Certificate, error) {
+	if strings.ContainsAny(host, ":/") {
+		return nil, fmt.Errorf("invalid host %s", host)
+	}
+	config := tls.Config{InsecureSkipVerify: true, ServerName: host}
+	nd := net.Dialer{Timeout: 10 * time.Second, Control: natto.Public}
+	dialer := tls.Dialer{NetDialer: &nd, Config: &config}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, "1958"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.(*tls.Conn).ConnectionState().PeerCertificates[0], nil
+}
+
+// checks cert was issued by the mailserver of the host it names
+func (p *Postbox) verify(cert *x509.Certificate) error {
+	lookup := p.Lookup
+	if lookup == nil {
+		lookup = ServerCertificate
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server, err := lookup(ctx, cert.DNSNames[0])
+	if err != nil {
+		return fmt.Errorf("can't reach %s: %v", cert.DNSNames[0], err)
+	}
+	if Fingerprint(server) == Fingerprint(cert) {
+		return nil
+	}
+	err = server.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	if err != nil {
+		return fmt.Errorf("certificate not signed by %s", cert.DNSNames[0])
+	}
+	return nil
+}
+
+func (p *Postbox) maxSize() int {
+	if p.MaxSize == 0 {
+		return 16 << 10
+	}
+	return p.MaxSize
+}
+
+func (p *Postbox) reply(w io.Writer, status int, meta string) {
+	fmt.Fprintf(w, "%d %s\r\n", status, meta)
+}
+
+// accepts misfin(C) requests, misfin://mailbox@host<TAB>length, and the
+// older misfin(B) ones carrying a single line message after a space
+func (p *Postbox) validate(request string) (*url.URL, int, string, error) {
+	request = strings.TrimRight(request, "\r\n")
+	target, length, ok := strings.Cut(request, "\t")
+	message := ""
+	if !ok {
+		target, message, _ = strings.Cut(request, " ")
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "misfin" || u.User == nil {
+		return nil, 0, "", fmt.Errorf("invalid address")
+	}
+	if !ok {
+		return u, -1, message, nil
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 {
+		return nil, 0, "", fmt.Errorf("invalid length")
+	}
+	return u, n, "", nil
+}
+
+func (p *Postbox) sender(rw io.ReadWriter) (string, string, int, error) {
+	peer, ok := rw.(natto.Peer)
+	if !ok || peer.Certificate() == nil {
+		return "", "", CertificateRequired, fmt.Errorf("certificate required")
+	}
+	cert := peer.Certificate()
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return "", "", CertificateNotValid, fmt.Errorf("certificate expired")
+	}
+	address, name, err := Identity(cert)
+	if err != nil {
+		return "", "", CertificateNotValid, err
+	}
+	allowed := p.Senders == nil
+	for _, pattern := range p.Senders {
+		if ok, _ := path.Match(pattern, address); ok {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return "", "", UnauthorisedSender, fmt.Errorf("unauthorised sender %s", address)
+	}
+	if err := p.verify(cert); err != nil {
+		return "", "", CertificateNotValid, err
+	}
+	return address, strings.Join(strings.Fields(name), " "), 0, nil
+}
+
+// indents lines that would pass for a sender or timestamp line
+func escape(message string) string {
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "<") || strings.HasPrefix(line, "@") {
+			lines[i] = " " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *Postbox) serviced(host string) bool {
+	if len(p.Hosts) == 0 {
+		return true
+	}
+	for _, h := range p.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Postbox) Handle(request string, rw io.ReadWriter) error {
+	if p.Root == "" {
+		p.Root = "."
+	}
+	u, length, message, err := p.validate(request)
+	if err != nil {
+		p.reply(rw, BadRequest, err.Error())
+		return err
+	}
+	if length > p.maxSize() || len(message) > p.maxSize() {
+		p.reply(rw, BadRequest, "message too long")
+		return fmt.Errorf("message too long")
+	}
+
+	address, name, status, err := p.sender(rw)
+	if err != nil {
+		p.reply(rw, status, err.Error())
+		return err
+	}
+	if !p.serviced(u.Hostname()) {
+		p.reply(rw, DomainNotServiced, "domain not serviced")
+		return fmt.Errorf("domain not serviced")
+	}
+	mailbox := u.User.Username()
+	file := filepath.Join(p.Root, mailbox+".gmi")
+	if !mailboxName.MatchString(mailbox) {
+		p.reply(rw, MailboxNotFound, "mailbox not found")
+		return fmt.Errorf("mailbox not found")
+	}
+	if _, err := os.Stat(file); err != nil {
+		p.reply(rw, MailboxNotFound, "mailbox not found")
+		return fmt.Errorf("mailbox not found")
+	}
+
+	if length >= 0 {
+		body := make([]byte, length)
+		_, err := io.ReadFull(rw, body)
+		if err != nil {
+			p.reply(rw, BadRequest, "short message")
+			return err
+		}
+		message = string(body)
+	}
+
+	entry := fmt.Sprintf("< %s %s\n@ %s\n%s\n\n", address, name,
+		time.Now().UTC().Format(time.RFC3339), escape(strings.TrimRight(message, "\r\n")))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = io.WriteString(f, entry)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		p.reply(rw, TemporaryFailure, "mailbox unwritable")
+		return err
+	}
+	p.reply(rw, Success, p.Fingerprint)
+	return nil
+}
+
+// sends message to mailbox@host[:port], identifying as cert
+func Send(ctx context.Context, address, message string, cert tls.Certificate) (*Response, error) {
+	mailbox, host, ok := strings.Cut(address, "@")
+	if !ok || mailbox == "" || host == "" {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "1958")
+	}
+	hostname, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         hostname,
+		Certificates:       []tls.Certificate{cert},
+	}
+	dialer := tls.Dialer{NetDialer: &net.Dialer{Timeout: 30 * time.Second}, Config: &config}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	target := url.URL{Scheme: "misfin", User: url.User(mailbox), Host: hostname}
+	fmt.Fprintf(conn, "%s\t%d\r\n%s", target.String(), len(message), message)
+	header, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	status, meta, _ := strings.Cut(strings.TrimSpace(header), " ")
+	i, err := strconv.Atoi(status)
+	if err != nil || len(status) != 2 {
+		return nil, fmt.Errorf("invalid status code %s", status)
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	return &Response{i, meta, state.PeerCertificates[0]}, nil
+}
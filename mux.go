@@ -0,0 +1,73 @@
+package natto
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// serves several protocols on one listener, telling them apart by the
+// first bytes: a tls handshake is gemini, a gemini:// url is plaintext
+// gemini, "host /path length" is spartan and anything else is a selector
+type Mux struct {
+	TLS      *tls.Config
+	Gemini   Capsule
+	Spartan  Capsule
+	Selector Capsule
+}
+
+func spartanRequest(request string) bool {
+	fields := strings.Fields(request)
+	if len(fields) != 3 || !strings.HasPrefix(fields[1], "/") {
+		return false
+	}
+	_, err := strconv.Atoi(fields[2])
+	return err == nil
+}
+
+func (m *Mux) Sniff(request string) Capsule {
+	switch {
+	case strings.HasPrefix(request, "gemini://"), strings.HasPrefix(request, "titan://"):
+		return m.Gemini
+	case spartanRequest(request):
+		return m.Spartan
+	}
+	return m.Selector
+}
+
+func (m *Mux) Serve(socket net.Conn) {
+	defer socket.Close()
+	reader := bufio.NewReader(socket)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	var conn net.Conn = &Conn{Conn: socket, Reader: reader}
+	secure := first[0] == 0x16
+	if secure {
+		if m.TLS == nil {
+			return
+		}
+		conn = tls.Server(conn, m.TLS)
+		reader = bufio.NewReader(conn)
+		defer conn.Close()
+	}
+
+	request, err := reader.ReadString('\n')
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	capsule := m.Sniff(request)
+	if secure {
+		capsule = m.Gemini
+	}
+	if capsule == nil {
+		return
+	}
+	capsule.Handle(request, &Conn{Conn: conn, Reader: reader})
+}
@@ -1,11 +1,26 @@
 package natto
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const Version = "0.2.0"
@@ -23,13 +38,134 @@ var Types = map[string]string{
 	".mp4":  "video/mp4",
 }
 
+type Limits struct {
+	Timeout  time.Duration
+	CPU      uint64
+	Memory   uint64
+	FileSize uint64
+	// concurrent scripts across the whole process, 0 for no limit
+	Processes int
+}
+
+// reads cpu=seconds,memory=size,filesize=size, sizes taking a K, M or G
+// suffix and 0 turning a limit off, so Limits can be a flag
+func (l *Limits) Set(s string) error {
+	for _, field := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		limit := map[string]*uint64{"cpu": &l.CPU, "memory": &l.Memory, "filesize": &l.FileSize}[key]
+		if limit == nil {
+			return fmt.Errorf("expected cpu, memory or filesize, not %s", key)
+		}
+		n, err := ParseSize(value)
+		if key == "cpu" {
+			n, err = strconv.ParseUint(value, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s %s", key, value)
+		}
+		*limit = n
+	}
+	return nil
+}
+
+func (l *Limits) String() string {
+	return fmt.Sprintf("cpu=%d,memory=%d,filesize=%d", l.CPU, l.Memory, l.FileSize)
+}
+
+func ParseSize(s string) (uint64, error) {
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	return n << shift, err
+}
+
+// a byte count flag, with the suffixes ParseSize takes
+type Size int64
+
+func (s *Size) Set(value string) error {
+	n, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = Size(n)
+	return nil
+}
+
+func (s *Size) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+// Memory caps the data segment (RLIMIT_DATA), not the address space,
+// so runtimes that reserve lots of it up front still start
+var CgiLimits = Limits{
+	Timeout:  30 * time.Second,
+	CPU:      10,
+	Memory:   256 << 20,
+	FileSize: 16 << 20,
+}
+
 type Capsule interface {
 	Handle(string, io.ReadWriter) error
 }
 
-type Stdio struct{}
+type Gateway interface {
+	Gate(w io.Writer, r io.Reader, env []string) error
+}
+
+// connections that know more about the client than the request line,
+// like the http mirror, pass extra cgi variables along this way
+type Environment interface {
+	Environ() []string
+}
+
+// connections carrying a tls client certificate
+type Peer interface {
+	Certificate() *x509.Certificate
+}
+
+var ErrBackend = errors.New("backend unavailable")
+
+// a connection whose request line has already been read, keeping
+// whatever the reader buffered past it for request bodies
+type Conn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+func (c *Conn) Certificate() *x509.Certificate {
+	t, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := t.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+type Stdio struct {
+	Reader io.Reader
+}
 
 func (s *Stdio) Read(p []byte) (n int, err error) {
+	if s.Reader != nil {
+		return s.Reader.Read(p)
+	}
 	return os.Stdin.Read(p)
 }
 
@@ -37,6 +173,40 @@ func (s *Stdio) Write(p []byte) (n int, err error) {
 	return os.Stdout.Write(p)
 }
 
+// reports whether any segment of a slash separated name starts with a
+// dot, like .redirects or .git/config, which uploads mustn't write
+func Hidden(name string) bool {
+	return slices.ContainsFunc(strings.Split(name, "/"), func(s string) bool {
+		return strings.HasPrefix(s, ".")
+	})
+}
+
+// writes size bytes from r to root/name through a temporary file, so
+// readers never see a partial upload
+func WriteFile(root, name string, r io.Reader, size int64) error {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.CopyN(f, r, size)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func Mime(path string) string {
 	mime := Types[filepath.Ext(path)]
 	if mime == "" {
@@ -45,14 +215,390 @@ func Mime(path string) string {
 	return mime
 }
 
-func Cgi(rw io.ReadWriter, path string, protocol string) error {
-	os.Setenv("GATEWAY_INTERFACE", "CGI/1.1")
-	os.Setenv("SERVER_PROTOCOL", protocol)
-	cmd := exec.Command(path)
-	cmd.Env = os.Environ()
-	cmd.Stdin = rw
-	cmd.Stdout = rw
-	err := cmd.Run()
+func Getenv(env []string, key string) string {
+	for _, kv := range env {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// a gateway for an scgi://host:port or fastcgi://host:port backend, or
+// for a unix socket as scgi:///run/app.sock. nil for other schemes
+func ParseGateway(backend string) (Gateway, error) {
+	u, err := url.Parse(backend)
+	if err != nil || (u.Scheme != "scgi" && u.Scheme != "fastcgi") {
+		return nil, nil
+	}
+	network, address := "tcp", u.Host
+	if u.Host == "" {
+		network, address = "unix", u.Path
+	}
+	if address == "" {
+		return nil, fmt.Errorf("%s lacks an address", backend)
+	}
+	if _, _, err := net.SplitHostPort(address); network == "tcp" && err != nil {
+		return nil, fmt.Errorf("%s lacks a port", backend)
+	}
+	if u.Scheme == "scgi" {
+		return &Scgi{Network: network, Address: address}, nil
+	}
+	return &FastCgi{Network: network, Address: address}, nil
+}
+
+func Route(gateways map[string]Gateway, host, path string) (string, Gateway, bool) {
+	var prefix string
+	var gateway Gateway
+	best := -1
+	for key, g := range gateways {
+		h, p := "", key
+		if !strings.HasPrefix(key, "/") {
+			h, p, _ = strings.Cut(key, "/")
+			p = "/" + p
+			if !strings.EqualFold(h, host) {
+				continue
+			}
+		}
+		p = strings.TrimSuffix(p, "/")
+		if path != p && !strings.HasPrefix(path, p+"/") {
+			continue
+		}
+		score := len(p)
+		if h != "" {
+			score += 1 << 16
+		}
+		if score > best {
+			best, prefix, gateway = score, p, g
+		}
+	}
+	return prefix, gateway, gateway != nil
+}
+
+type Tracker struct {
+	io.Writer
+	Written int64
+}
+
+func (t *Tracker) Write(p []byte) (n int, err error) {
+	n, err = t.Writer.Write(p)
+	t.Written += int64(n)
+	return n, err
+}
+
+type Header struct {
+	Writer  io.Writer
+	Valid   func(string) error
+	Failure string
+	buf     []byte
+	done    bool
+	bad     bool
+}
+
+func (h *Header) Write(p []byte) (n int, err error) {
+	if h.bad {
+		return len(p), nil
+	}
+	if h.done {
+		return h.Writer.Write(p)
+	}
+	h.buf = append(h.buf, p...)
+	line, rest, ok := bytes.Cut(h.buf, []byte("\n"))
+	if !ok {
+		if len(h.buf) > 1029 {
+			h.reject()
+		}
+		return len(p), nil
+	}
+	if !h.header(string(line)) {
+		return len(p), nil
+	}
+	h.buf = nil
+	if len(rest) > 0 {
+		_, err = h.Writer.Write(rest)
+	}
+	return len(p), err
+}
+
+func (h *Header) header(line string) bool {
+	line = strings.TrimRight(line, "\r")
+	h.done = true
+	err := h.Valid(line)
+	if err != nil {
+		log.Printf("invalid header %q: %v", line, err)
+		h.reject()
+		return false
+	}
+	fmt.Fprintf(h.Writer, "%s\r\n", line)
+	return true
+}
+
+func (h *Header) reject() {
+	h.done = true
+	h.bad = true
+	h.buf = nil
+	io.WriteString(h.Writer, h.Failure)
+}
+
+func (h *Header) Close() error {
+	if !h.done && len(h.buf) > 0 {
+		h.header(string(h.buf))
+	}
+	return nil
+}
+
+type HttpHeader struct {
+	Writer io.Writer
+	Format func(status int, meta string) string
+	buf    []byte
+	done   bool
+	quiet  bool
+}
+
+func httpHeaderLine(line []byte) bool {
+	k, _, ok := bytes.Cut(line, []byte(":"))
+	if !ok || len(k) == 0 || k[0] >= '0' && k[0] <= '9' {
+		return false
+	}
+	for _, c := range k {
+		if !(c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *HttpHeader) Write(p []byte) (n int, err error) {
+	if h.quiet {
+		return len(p), nil
+	}
+	if h.done {
+		return h.Writer.Write(p)
+	}
+	h.buf = append(h.buf, p...)
+	line, _, ok := bytes.Cut(h.buf, []byte("\n"))
+	if !ok && len(h.buf) < 8192 {
+		return len(p), nil
+	}
+	if !ok || !httpHeaderLine(line) {
+		return len(p), h.flush()
+	}
+	block, body, ok := bytes.Cut(bytes.ReplaceAll(h.buf, []byte("\r\n"), []byte("\n")), []byte("\n\n"))
+	if !ok {
+		if len(h.buf) >= 8192 {
+			return len(p), h.flush()
+		}
+		return len(p), nil
+	}
+	h.done = true
+	h.buf = nil
+	_, err = io.WriteString(h.Writer, h.header(string(block)))
+	if err == nil && len(body) > 0 && !h.quiet {
+		_, err = h.Writer.Write(body)
+	}
+	return len(p), err
+}
+
+func (h *HttpHeader) header(block string) string {
+	status := 0
+	var mime, reason, location string
+	for _, line := range strings.Split(block, "\n") {
+		k, v, _ := strings.Cut(line, ":")
+		v = strings.TrimSpace(v)
+		switch strings.ToLower(k) {
+		case "status":
+			code, text, _ := strings.Cut(v, " ")
+			status, _ = strconv.Atoi(code)
+			reason = text
+		case "content-type":
+			mime = v
+		case "location":
+			location = v
+		}
+	}
+	switch {
+	case status == 0 && location != "":
+		status = 302
+	case status == 0:
+		status = 200
+	}
+	// only successful responses have a body in gemini and spartan
+	h.quiet = status/100 != 2
+	switch status / 100 {
+	case 2:
+		return h.Format(status, mime)
+	case 3:
+		return h.Format(status, location)
+	default:
+		return h.Format(status, reason)
+	}
+}
+
+func (h *HttpHeader) flush() error {
+	h.done = true
+	_, err := h.Writer.Write(h.buf)
+	h.buf = nil
+	return err
+}
+
+func (h *HttpHeader) Close() error {
+	if !h.done && len(h.buf) > 0 {
+		return h.flush()
+	}
+	return nil
+}
+
+type stderr struct {
+	name string
+	buf  []byte
+}
+
+func (s *stderr) Write(p []byte) (n int, err error) {
+	s.buf = append(s.buf, p...)
+	for {
+		line, rest, ok := bytes.Cut(s.buf, []byte("\n"))
+		if !ok {
+			break
+		}
+		log.Printf("%s: %s", s.name, line)
+		s.buf = rest
+	}
+	if len(s.buf) > 4096 {
+		s.Flush()
+	}
+	return len(p), nil
+}
+
+func (s *stderr) Flush() {
+	if len(s.buf) > 0 {
+		log.Printf("%s: %s", s.name, s.buf)
+		s.buf = nil
+	}
+}
+
+type CgiRules struct {
+	Off        bool
+	Executable bool
+	Dirs       []string
+	Extensions []string
+}
+
+func (r *CgiRules) Match(path string, info fs.FileInfo) bool {
+	if r.Off || info.IsDir() {
+		return false
+	}
+	if r.Executable && info.Mode()&0111 != 0 {
+		return true
+	}
+	for _, dir := range r.Dirs {
+		if strings.HasPrefix(path, strings.Trim(dir, "/")+"/") {
+			return true
+		}
+	}
+	if r.Extensions == nil {
+		return Mime(path) == "application/cgi"
+	}
+	return slices.Contains(r.Extensions, filepath.Ext(path))
+}
+
+// reports whether a new file at path would run as cgi, so uploads
+// can't plant scripts
+func (r *CgiRules) Covers(path string) bool {
+	if Mime(path) == "application/cgi" || slices.Contains(r.Extensions, filepath.Ext(path)) {
+		return true
+	}
+	return slices.ContainsFunc(r.Dirs, func(dir string) bool {
+		return strings.HasPrefix(path, strings.Trim(dir, "/")+"/")
+	})
+}
+
+func (r *CgiRules) Find(fsys fs.FS, path string) (string, string, bool) {
+	if r.Off {
+		return "", "", false
+	}
+	path = "/" + strings.TrimPrefix(path, "/")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := range segments {
+		script := strings.Join(segments[:i+1], "/")
+		info, err := fs.Stat(fsys, script)
+		if err != nil {
+			return "", "", false
+		}
+		if info.IsDir() {
+			continue
+		}
+		if !r.Match(script, info) {
+			return "", "", false
+		}
+		return script, strings.TrimPrefix(path, "/"+script), true
+	}
+	return "", "", false
+}
+
+// servers that run cgi call this first thing in main. when this process
+// is the cgi shim rather than the server, it never returns
+func Shim() {
+	rlimits()
+	launches()
+}
+
+func local(cmd *exec.Cmd) error {
+	err := cmd.Start()
+	if err == nil {
+		err = cmd.Wait()
+	}
+	return err
+}
+
+var pool struct {
+	sync.Once
+	slots chan struct{}
+}
+
+func Cgi(w io.Writer, r io.Reader, path string, protocol string, env ...string) error {
+	ctx := context.Background()
+	if CgiLimits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CgiLimits.Timeout)
+		defer cancel()
+	}
+	if CgiLimits.Processes > 0 {
+		pool.Do(func() { pool.slots = make(chan struct{}, CgiLimits.Processes) })
+		select {
+		case pool.slots <- struct{}{}:
+			defer func() { <-pool.slots }()
+		case <-ctx.Done():
+			return fmt.Errorf("cgi timed out waiting for a free slot")
+		}
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("cgi trouble: %s", err.Error())
+	}
+	name, args, extra := limited(path, CgiLimits)
+	cmd := exec.CommandContext(ctx, name)
+	cmd.Args = args
+	cmd.Dir = filepath.Dir(path)
+	cmd.Env = append(os.Environ(),
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_PROTOCOL="+protocol,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Env = append(cmd.Env, extra...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	log := &stderr{name: filepath.Base(path)}
+	defer log.Flush()
+	cmd.Stderr = log
+	group(cmd)
+	cmd.WaitDelay = time.Second
+
+	err = start(ctx, cmd)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("cgi timed out after %s", CgiLimits.Timeout)
+	}
 	if err != nil {
 		return fmt.Errorf("cgi trouble: %s", err.Error())
 	}
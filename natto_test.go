@@ -1,14 +1,44 @@
 package natto_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"blekksprut.net/natto"
+	"blekksprut.net/natto/finger"
 	"blekksprut.net/natto/gemini"
+	"blekksprut.net/natto/gemtext"
+	"blekksprut.net/natto/gopher"
+	"blekksprut.net/natto/guppy"
+	"blekksprut.net/natto/misfin"
+	"blekksprut.net/natto/nex"
 	"blekksprut.net/natto/spartan"
 )
 
@@ -197,3 +227,1629 @@ func TestGeminiRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestCgiTimeout(t *testing.T) {
+	timeout := natto.CgiLimits.Timeout
+	natto.CgiLimits.Timeout = 100 * time.Millisecond
+	defer func() { natto.CgiLimits.Timeout = timeout }()
+
+	var buf bytes.Buffer
+	err := g.Handle("gemini://localhost/slow.cgi", &buf)
+	if err == nil {
+		t.Errorf("request should have timed out")
+	}
+	if !strings.HasPrefix(buf.String(), "42 ") {
+		t.Errorf("expected cgi error, got %q", buf.String())
+	}
+}
+
+func TestMain(m *testing.M) {
+	natto.Shim()
+	os.Exit(m.Run())
+}
+
+func TestCgiLimits(t *testing.T) {
+	limits := natto.CgiLimits
+	defer func() { natto.CgiLimits = limits }()
+	err := natto.CgiLimits.Set("cpu=3,memory=64M,filesize=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if natto.CgiLimits.Set("memory=lots") == nil {
+		t.Errorf("invalid size should have been refused")
+	}
+
+	root := t.TempDir()
+	script := "#!/bin/sh\nprintf '20 text/plain\\r\\n'\necho $(ulimit -t) $(ulimit -d) $(ulimit -f)\n"
+	os.WriteFile(filepath.Join(root, "limits.cgi"), []byte(script), 0755)
+	var buf bytes.Buffer
+	(&gemini.Capsule{Root: root}).Handle("gemini://localhost/limits.cgi", &buf)
+	if buf.String() != "20 text/plain\r\n3 65536 unlimited\n" {
+		t.Errorf("limits weren't applied before exec: %q", buf.String())
+	}
+}
+
+func TestSpartanCgiTimeout(t *testing.T) {
+	timeout := natto.CgiLimits.Timeout
+	natto.CgiLimits.Timeout = 100 * time.Millisecond
+	defer func() { natto.CgiLimits.Timeout = timeout }()
+
+	var buf bytes.Buffer
+	err := s.Handle("localhost /slow.cgi 0", &buf)
+	if err == nil {
+		t.Errorf("request should have timed out")
+	}
+	if !strings.HasPrefix(buf.String(), "5 ") {
+		t.Errorf("expected server error, got %q", buf.String())
+	}
+}
+
+func TestStrictCgi(t *testing.T) {
+	strict := gemini.Capsule{Strict: true}
+	var buf bytes.Buffer
+	err := strict.Handle("gemini://localhost/hello.cgi", &buf)
+	if err != nil {
+		t.Errorf("request shouldn't have failed")
+	}
+	if buf.String() != "20 text/plain\r\nhello world\n" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestStrictCgiLineEndings(t *testing.T) {
+	strict := gemini.Capsule{Strict: true}
+	var buf bytes.Buffer
+	strict.Handle("gemini://localhost/failure.cgi", &buf)
+	if !strings.HasPrefix(buf.String(), "50 oops\r\n") {
+		t.Errorf("header should have been normalised, got %q", buf.String())
+	}
+}
+
+func TestStrictCgiGarbage(t *testing.T) {
+	strict := gemini.Capsule{Strict: true}
+	var buf bytes.Buffer
+	strict.Handle("gemini://localhost/garbage.cgi", &buf)
+	if buf.String() != "42 invalid cgi response\r\n" {
+		t.Errorf("garbage should have been rejected, got %q", buf.String())
+	}
+}
+
+func TestSpartanStrictCgi(t *testing.T) {
+	strict := spartan.Space{Strict: true}
+	var buf bytes.Buffer
+	strict.Handle("localhost /hello.cgi 0", &buf)
+	if buf.String() != "5 invalid cgi response\r\n" {
+		t.Errorf("gemini header should have been rejected, got %q", buf.String())
+	}
+}
+
+func TestCgiPathInfo(t *testing.T) {
+	var buf bytes.Buffer
+	err := g.Handle("gemini://localhost/cgi-bin/env.cgi/posts/42", &buf)
+	if err != nil {
+		t.Errorf("request shouldn't have failed")
+	}
+	if buf.String() != "20 text/plain\r\ncgi-bin /cgi-bin/env.cgi /posts/42\n" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestCgiNotAFile(t *testing.T) {
+	err := g.Handle("gemini://localhost/README.gmi/posts/42", &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("request should have failed")
+	}
+}
+
+func TestSpartanCgiPathInfo(t *testing.T) {
+	var buf bytes.Buffer
+	err := s.Handle("localhost /cgi-bin/env.cgi/posts/ 0", &buf)
+	if err != nil {
+		t.Errorf("request shouldn't have failed")
+	}
+	if buf.String() != "20 text/plain\r\ncgi-bin /cgi-bin/env.cgi /posts/\n" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestCgiDisabled(t *testing.T) {
+	off := gemini.Capsule{Cgi: natto.CgiRules{Off: true}}
+	var buf bytes.Buffer
+	err := off.Handle("gemini://localhost/hello.cgi", &buf)
+	if err == nil {
+		t.Errorf("request should have failed")
+	}
+	if strings.Contains(buf.String(), "#!/bin/sh") {
+		t.Errorf("script source should never be served")
+	}
+}
+
+func TestCgiExecutable(t *testing.T) {
+	exec := gemini.Capsule{Cgi: natto.CgiRules{Executable: true}}
+	var buf bytes.Buffer
+	err := exec.Handle("gemini://localhost/cgi-bin/hello", &buf)
+	if err != nil || !strings.HasSuffix(buf.String(), "no extension\n") {
+		t.Errorf("executable should have been run, got %q", buf.String())
+	}
+}
+
+func TestCgiDirs(t *testing.T) {
+	bin := spartan.Space{Cgi: natto.CgiRules{Dirs: []string{"/cgi-bin/"}}}
+	var buf bytes.Buffer
+	err := bin.Handle("localhost /cgi-bin/hello 0", &buf)
+	if err != nil || !strings.HasSuffix(buf.String(), "no extension\n") {
+		t.Errorf("cgi-bin script should have been run, got %q", buf.String())
+	}
+}
+
+func TestCgiExtensions(t *testing.T) {
+	ext := gemini.Capsule{Cgi: natto.CgiRules{Extensions: []string{".sh"}}}
+	err := ext.Handle("gemini://localhost/hello.cgi", &bytes.Buffer{})
+	if err == nil {
+		t.Errorf(".cgi shouldn't run when only .sh is configured")
+	}
+}
+
+func scgiServer(t *testing.T) string {
+	sock := filepath.Join(t.TempDir(), "scgi.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			size, _ := r.ReadString(':')
+			n, _ := strconv.Atoi(strings.TrimSuffix(size, ":"))
+			raw := make([]byte, n+1)
+			io.ReadFull(r, raw)
+			fields := strings.Split(string(raw[:n]), "\x00")
+			env := map[string]string{}
+			for i := 0; i+1 < len(fields); i += 2 {
+				env[fields[i]] = fields[i+1]
+			}
+			length, _ := strconv.Atoi(env["CONTENT_LENGTH"])
+			body := make([]byte, length)
+			io.ReadFull(r, body)
+			fmt.Fprintf(conn, "20 text/plain\r\n%s %s %s %s",
+				env["SCGI"], env["SCRIPT_NAME"], env["PATH_INFO"], body)
+			conn.Close()
+		}
+	}()
+	return sock
+}
+
+func TestScgi(t *testing.T) {
+	backend := &natto.Scgi{Network: "unix", Address: scgiServer(t)}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/app": backend}}
+	var buf bytes.Buffer
+	err := c.Handle("gemini://localhost/app/posts/42", &buf)
+	if err != nil {
+		t.Errorf("request shouldn't have failed: %v", err)
+	}
+	if buf.String() != "20 text/plain\r\n1 /app /posts/42 " {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestSpartanScgi(t *testing.T) {
+	backend := &natto.Scgi{Network: "unix", Address: scgiServer(t)}
+	c := spartan.Space{Gateways: map[string]natto.Gateway{"/": backend}}
+	var buf bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("hello"), &buf}
+	err := c.Handle("localhost /guestbook 5", rw)
+	if err != nil {
+		t.Errorf("request shouldn't have failed: %v", err)
+	}
+	if buf.String() != "20 text/plain\r\n1  /guestbook hello" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestParseGateway(t *testing.T) {
+	backend, err := natto.ParseGateway("scgi://" + scgiServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/app": backend}}
+	var buf bytes.Buffer
+	c.Handle("gemini://localhost/app/posts", &buf)
+	if buf.String() != "20 text/plain\r\n1 /app /posts " {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+	if g, err := natto.ParseGateway("fastcgi://localhost:9000"); err != nil || g.(*natto.FastCgi).Network != "tcp" {
+		t.Errorf("unexpected fastcgi gateway %v %v", g, err)
+	}
+	if g, err := natto.ParseGateway("gemini://localhost"); g != nil || err != nil {
+		t.Errorf("gemini isn't a gateway: %v %v", g, err)
+	}
+	if _, err := natto.ParseGateway("scgi://localhost"); err == nil {
+		t.Errorf("missing port should have failed")
+	}
+}
+
+func TestScgiUnavailable(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "missing.sock")
+	backend := &natto.Scgi{Network: "unix", Address: sock}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/app": backend}}
+	var buf bytes.Buffer
+	err := c.Handle("gemini://localhost/app", &buf)
+	if err == nil {
+		t.Errorf("request should have failed")
+	}
+	if !strings.HasPrefix(buf.String(), "43 ") {
+		t.Errorf("expected proxy error, got %q", buf.String())
+	}
+}
+
+func fastCgiServer(t *testing.T) string {
+	sock := filepath.Join(t.TempDir(), "fcgi.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/gemini")
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	return sock
+}
+
+func TestFastCgi(t *testing.T) {
+	backend := &natto.FastCgi{
+		Network: "unix",
+		Address: fastCgiServer(t),
+		Env:     []string{"SERVER_PROTOCOL=HTTP/1.1"},
+	}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/php": backend}}
+	for range 2 {
+		var buf bytes.Buffer
+		err := c.Handle("gemini://localhost/php/index.php", &buf)
+		if err != nil {
+			t.Errorf("request shouldn't have failed: %v", err)
+		}
+		if buf.String() != "20 text/gemini\r\nGET /php/index.php " {
+			t.Errorf("unexpected response %q", buf.String())
+		}
+	}
+}
+
+func TestFastCgiNotFound(t *testing.T) {
+	backend := &natto.FastCgi{
+		Network: "unix",
+		Address: fastCgiServer(t),
+		Env:     []string{"SERVER_PROTOCOL=HTTP/1.1"},
+	}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/php": backend}}
+	var buf bytes.Buffer
+	c.Handle("gemini://localhost/php/missing", &buf)
+	if buf.String() != "51 Not Found\r\n" {
+		t.Errorf("expected not found, got %q", buf.String())
+	}
+}
+
+func TestFastCgiBusy(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "fcgi.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var mu sync.Mutex
+	running, most := 0, 0
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		fmt.Fprint(w, "done")
+	}))
+
+	backend := &natto.FastCgi{
+		Network: "unix",
+		Address: sock,
+		Conns:   2,
+		Env:     []string{"SERVER_PROTOCOL=HTTP/1.1"},
+	}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/php": backend}}
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			c.Handle("gemini://localhost/php/slow", &buf)
+			if !strings.HasSuffix(buf.String(), "done") {
+				t.Errorf("unexpected response %q", buf.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Errorf("backend saw %d requests at once", most)
+	}
+}
+
+func TestSpartanFastCgi(t *testing.T) {
+	backend := &natto.FastCgi{
+		Network: "unix",
+		Address: fastCgiServer(t),
+		Env:     []string{"SERVER_PROTOCOL=HTTP/1.1"},
+	}
+	c := spartan.Space{Gateways: map[string]natto.Gateway{"/": backend}}
+	var buf bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("hello"), &buf}
+	err := c.Handle("localhost /guestbook 5", rw)
+	if err != nil {
+		t.Errorf("request shouldn't have failed: %v", err)
+	}
+	if buf.String() != "2 text/gemini\r\nPOST /guestbook hello" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func geminiBackend(t *testing.T, response string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveBackend(t, l, response)
+}
+
+func serveBackend(t *testing.T, l net.Listener, response string) string {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			request, _ := bufio.NewReader(conn).ReadString('\n')
+			request = strings.TrimSpace(request)
+			io.WriteString(conn, strings.ReplaceAll(response, "$url", request))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProxy(t *testing.T) {
+	backend := &gemini.Proxy{Backend: geminiBackend(t, "20 text/gemini\r\n$url")}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/wiki": backend}}
+	var buf bytes.Buffer
+	err := c.Handle("gemini://localhost/wiki/page?q", &buf)
+	if err != nil {
+		t.Errorf("request shouldn't have failed: %v", err)
+	}
+	if buf.String() != "20 text/gemini\r\ngemini://localhost/wiki/page?q" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{identity(t, "", "backend", "backend.local")}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveBackend(t, l, "20 text/gemini\r\n$url")
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{
+		"example.com":  &gemini.Proxy{Backend: addr, TLS: true, ServerName: "backend.local"},
+		"backend.test": &gemini.Proxy{Backend: addr, TLS: true},
+	}}
+	var buf bytes.Buffer
+	c.Handle("gemini://example.com/", &buf)
+	if buf.String() != "20 text/gemini\r\ngemini://example.com/" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+	buf.Reset()
+	c.Handle("gemini://backend.test/", &buf)
+	if !strings.HasPrefix(buf.String(), "43 ") {
+		t.Errorf("certificate for the wrong host should fail, got %q", buf.String())
+	}
+
+	sum := sha256.Sum256(config.Certificates[0].Certificate[0])
+	for fingerprint, expected := range map[string]string{
+		strings.ToUpper(hex.EncodeToString(sum[:])): "20 ",
+		strings.Repeat("0", 64):                     "43 ",
+	} {
+		buf.Reset()
+		pinned := &gemini.Proxy{Backend: addr, TLS: true, ServerName: "backend.local", Fingerprint: fingerprint}
+		c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/": pinned}}
+		c.Handle("gemini://localhost/", &buf)
+		if !strings.HasPrefix(buf.String(), expected) {
+			t.Errorf("pinning %s: expected %q, got %q", fingerprint, expected, buf.String())
+		}
+	}
+}
+
+func TestResponseConn(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{identity(t, "", "backend", "localhost")}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveBackend(t, l, "20 text/gemini\r\nhi")
+	_, port, _ := net.SplitHostPort(addr)
+	res, err := gemini.Request(context.Background(), "gemini://localhost:"+port+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	if res.Conn.ConnectionState().Version == 0 {
+		t.Errorf("expected a tls connection")
+	}
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	input := &gemini.Proxy{Backend: geminiBackend(t, "10 name?\r\n")}
+	cert := &gemini.Proxy{Backend: geminiBackend(t, "60 who are you\r\n")}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{
+		"localhost":       input,
+		"localhost/certs": cert,
+	}}
+	var buf bytes.Buffer
+	c.Handle("gemini://localhost/", &buf)
+	if buf.String() != "10 name?\r\n" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+	buf.Reset()
+	c.Handle("gemini://localhost/certs/", &buf)
+	if buf.String() != "60 who are you\r\n" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+
+	bare := &gemini.Proxy{Backend: geminiBackend(t, "20\r\nhi")}
+	buf.Reset()
+	(&gemini.Capsule{Gateways: map[string]natto.Gateway{"/": bare}}).Handle("gemini://localhost/", &buf)
+	if buf.String() != "20\r\nhi" {
+		t.Errorf("header should have been relayed untouched, got %q", buf.String())
+	}
+}
+
+func TestProxyUnavailable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	backend := &gemini.Proxy{Backend: l.Addr().String()}
+	c := gemini.Capsule{Gateways: map[string]natto.Gateway{"/": backend}}
+	var buf bytes.Buffer
+	c.Handle("gemini://localhost/", &buf)
+	if buf.String() != "43 backend unavailable\r\n" {
+		t.Errorf("expected proxy error, got %q", buf.String())
+	}
+}
+
+func TestProxyRefused(t *testing.T) {
+	var buf bytes.Buffer
+	err := g.Handle("spartan://localhost/README.gmi", &buf)
+	if err == nil || buf.String() != "53 proxy request refused\r\n" {
+		t.Errorf("expected proxy refusal, got %q", buf.String())
+	}
+}
+
+func TestForeignHostRefused(t *testing.T) {
+	c := gemini.Capsule{Hosts: []string{"localhost"}}
+	var buf bytes.Buffer
+	err := c.Handle("gemini://elsewhere.example/", &buf)
+	if err == nil || !strings.HasPrefix(buf.String(), "53 ") {
+		t.Errorf("expected proxy refusal, got %q", buf.String())
+	}
+	err = c.Handle("gemini://LOCALHOST/README.gmi", &bytes.Buffer{})
+	if err != nil {
+		t.Errorf("own host shouldn't have been refused")
+	}
+}
+
+func TestForwardSpartan(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			request, _ := bufio.NewReader(conn).ReadString('\n')
+			s.Handle(request, conn)
+			conn.Close()
+		}
+	}()
+
+	c := gemini.Capsule{Forward: &gemini.Forward{Hosts: []string{"127.0.0.1"}}}
+	var buf bytes.Buffer
+	err = c.Handle("spartan://"+l.Addr().String()+"/README.gmi", &buf)
+	if err != nil || !strings.HasPrefix(buf.String(), "20 text/gemini\r\n# natto") {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+
+	for _, hosts := range [][]string{nil, {"*"}, {"127.0.0.*"}} {
+		buf.Reset()
+		c := gemini.Capsule{Forward: &gemini.Forward{Hosts: hosts}}
+		c.Handle("spartan://"+l.Addr().String()+"/README.gmi", &buf)
+		if !strings.HasPrefix(buf.String(), "53 ") {
+			t.Errorf("%v shouldn't reach loopback, got %q", hosts, buf.String())
+		}
+	}
+
+	buf.Reset()
+	c.Handle("spartan://elsewhere.example/", &buf)
+	if !strings.HasPrefix(buf.String(), "53 ") {
+		t.Errorf("host outside the allowlist should be refused, got %q", buf.String())
+	}
+
+	// a name matched by a wildcard is checked where it's dialled
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	n, _ := strconv.Atoi(port)
+	buf.Reset()
+	c = gemini.Capsule{Forward: &gemini.Forward{Hosts: []string{"local*"}, Ports: []int{n}}}
+	c.Handle("spartan://localhost:"+port+"/README.gmi", &buf)
+	if !strings.HasPrefix(buf.String(), "43 ") {
+		t.Errorf("localhost shouldn't be dialled through a wildcard, got %q", buf.String())
+	}
+
+	f := gemini.Forward{Hosts: []string{"*"}}
+	for _, raw := range []string{
+		"gemini://example.com:25/", "http://example.com:6379/",
+		"gemini://100.64.0.1/", "gemini://0.0.0.1/", "gemini://[::1]/",
+	} {
+		u, _ := url.Parse(raw)
+		if f.Allowed(u) {
+			t.Errorf("%s shouldn't be allowed", raw)
+		}
+	}
+	u, _ := url.Parse("gemini://example.com:1965/")
+	if !f.Allowed(u) {
+		t.Errorf("%s should be allowed", u)
+	}
+}
+
+func TestForwardHttp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "hello over http")
+	}))
+	defer server.Close()
+
+	c := gemini.Capsule{Forward: &gemini.Forward{Schemes: []string{"http"}, Hosts: []string{"127.0.0.1"}}}
+	var buf bytes.Buffer
+	c.Handle(server.URL+"/", &buf)
+	if buf.String() != "20 text/plain\r\nhello over http" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+	buf.Reset()
+	c.Handle(server.URL+"/old", &buf)
+	if buf.String() != "31 "+server.URL+"/new\r\n" {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestGemtextHTML(t *testing.T) {
+	doc := "# title\n=> /next <next>\n* one\n* two\n```\n<pre>\n```\n=: /post say hi\n"
+	var buf bytes.Buffer
+	gemtext.HTML(&buf, strings.NewReader(doc), func(link string) string {
+		return "/portal" + link
+	})
+	expected := "<h1>title</h1>\n" +
+		"<p class=\"link\"><a href=\"/portal/next\">&lt;next&gt;</a></p>\n" +
+		"<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n" +
+		"<pre title=\"\">&lt;pre&gt;\n</pre>\n" +
+		"<form class=\"prompt\" method=\"post\" action=\"/portal/post\">" +
+		"<label>say hi <textarea name=\"data\"></textarea></label>" +
+		"<button>send</button></form>\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected html %q", buf.String())
+	}
+}
+
+func TestGemtextUnsafeLinks(t *testing.T) {
+	doc := "=> javascript:alert(1) click\n=: data:text/html,hi say\n=> https://example.com ok\n"
+	var buf bytes.Buffer
+	gemtext.HTML(&buf, strings.NewReader(doc), nil)
+	expected := "<p class=\"link\">click</p>\n" +
+		"<p class=\"prompt\">say</p>\n" +
+		"<p class=\"link\"><a href=\"https://example.com\">ok</a></p>\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected html %q", buf.String())
+	}
+}
+
+func mirror(path string) *http.Response {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://localhost:8080"+path, nil)
+	m := gemini.Mirror{Capsule: &gemini.Capsule{}}
+	m.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestMirror(t *testing.T) {
+	res := mirror("/README.gmi")
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "<h1>natto</h1>") {
+		t.Errorf("unexpected response %d %q", res.StatusCode, body)
+	}
+}
+
+func TestMirrorNotFound(t *testing.T) {
+	res := mirror("/notFound")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", res.StatusCode)
+	}
+}
+
+func TestMirrorCgi(t *testing.T) {
+	res := mirror("/hello.cgi")
+	body, _ := io.ReadAll(res.Body)
+	if res.Header.Get("Content-Type") != "text/plain" || string(body) != "hello world\n" {
+		t.Errorf("unexpected response %q %q", res.Header.Get("Content-Type"), body)
+	}
+}
+
+func titan(root, request, body string) string {
+	c := gemini.Capsule{Root: root, Titan: &gemini.Titan{Tokens: []string{"secret"}, MaxSize: 64}}
+	var buf bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(body), &buf}
+	c.Handle(request, rw)
+	return buf.String()
+}
+
+func TestTitanUpload(t *testing.T) {
+	root := t.TempDir()
+	res := titan(root, "titan://localhost/notes/new.gmi;size=5;mime=text/gemini;token=secret", "hello")
+	if res != "30 gemini://localhost/notes/new.gmi\r\n" {
+		t.Errorf("unexpected response %q", res)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "notes", "new.gmi"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("upload wasn't written: %q %v", data, err)
+	}
+	res = titan(root, "titan://localhost/notes/new.gmi;size=0;token=secret", "")
+	if _, err := os.Stat(filepath.Join(root, "notes", "new.gmi")); !os.IsNotExist(err) {
+		t.Errorf("empty upload should have removed the file")
+	}
+}
+
+func TestTitanUnauthorised(t *testing.T) {
+	root := t.TempDir()
+	res := titan(root, "titan://localhost/new.gmi;size=5;token=wrong", "hello")
+	if !strings.HasPrefix(res, "60 ") {
+		t.Errorf("unexpected response %q", res)
+	}
+	if _, err := os.Stat(filepath.Join(root, "new.gmi")); !os.IsNotExist(err) {
+		t.Errorf("unauthorised upload was written")
+	}
+}
+
+func TestTitanLimits(t *testing.T) {
+	root := t.TempDir()
+	res := titan(root, "titan://localhost/big.gmi;size=65;token=secret", strings.Repeat("_", 65))
+	if !strings.HasPrefix(res, "59 ") {
+		t.Errorf("oversized upload should have been refused: %q", res)
+	}
+	res = titan(root, "titan://localhost/evil.cgi;size=5;token=secret", "hello")
+	if !strings.HasPrefix(res, "50 ") {
+		t.Errorf("cgi upload should have been refused: %q", res)
+	}
+	res = titan(root, "titan://localhost/.redirects;size=5;token=secret", "hello")
+	if !strings.HasPrefix(res, "50 ") {
+		t.Errorf("dotfile upload should have been refused: %q", res)
+	}
+	res = titan(root, "titan://localhost/new.gmi;token=secret", "hello")
+	if !strings.HasPrefix(res, "59 ") {
+		t.Errorf("upload without size should have been refused: %q", res)
+	}
+}
+
+func TestTitanDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	g.Handle("titan://localhost/new.gmi;size=5;token=secret", &buf)
+	if !strings.HasPrefix(buf.String(), "53 ") {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+}
+
+func TestTitanCgi(t *testing.T) {
+	root := t.TempDir()
+	script := "#!/bin/sh\nprintf \"20 text/plain\\r\\n\"\necho \"$CONTENT_LENGTH $CONTENT_TYPE $(cat)\"\n"
+	os.WriteFile(filepath.Join(root, "wiki.cgi"), []byte(script), 0755)
+	res := titan(root, "titan://localhost/wiki.cgi/page;size=5;mime=text/plain;token=secret", "hello")
+	if res != "20 text/plain\r\n5 text/plain hello\n" {
+		t.Errorf("unexpected response %q", res)
+	}
+}
+
+func spartanUpload(c *spartan.Space, request, body string) string {
+	var buf bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(body), &buf}
+	c.Handle(request, rw)
+	return buf.String()
+}
+
+func TestSpartanUpload(t *testing.T) {
+	root := t.TempDir()
+	c := &spartan.Space{Root: root, Uploads: &spartan.Uploads{Dirs: []string{"wiki"}}}
+	res := spartanUpload(c, "localhost /wiki/page.gmi 5", "hello")
+	if res != "3 /wiki/page.gmi\r\n" {
+		t.Errorf("unexpected response %q", res)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "wiki", "page.gmi"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("upload wasn't written: %q %v", data, err)
+	}
+	res = spartanUpload(c, "localhost /wiki/page.gmi 3", "bye")
+	if res != "4 already exists\r\n" {
+		t.Errorf("upload shouldn't have overwritten: %q", res)
+	}
+	c.Uploads.Overwrite = true
+	res = spartanUpload(c, "localhost /wiki/page.gmi 3", "bye")
+	if res != "3 /wiki/page.gmi\r\n" {
+		t.Errorf("upload should have overwritten: %q", res)
+	}
+}
+
+func TestSpartanPaste(t *testing.T) {
+	root := t.TempDir()
+	c := &spartan.Space{Root: root, Uploads: &spartan.Uploads{Dirs: []string{"paste"}}}
+	res := spartanUpload(c, "localhost /paste/ 5", "hello")
+	name, ok := strings.CutPrefix(strings.TrimSpace(res), "3 /")
+	if !ok || !strings.HasSuffix(name, ".txt") {
+		t.Fatalf("unexpected response %q", res)
+	}
+	data, err := os.ReadFile(filepath.Join(root, name))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("paste wasn't written: %q %v", data, err)
+	}
+}
+
+func TestSpartanUploadRefused(t *testing.T) {
+	root := t.TempDir()
+	c := &spartan.Space{Root: root, Uploads: &spartan.Uploads{
+		Dirs:    []string{"paste"},
+		MaxSize: 8,
+		Types:   []string{"text/plain"},
+	}}
+	for request, body := range map[string]string{
+		"localhost /elsewhere.gmi 5":    "hello",
+		"localhost /paste/big.txt 9":    "123456789",
+		"localhost /paste/evil.cgi 5":   "hello",
+		"localhost /paste/.redirects 5": "hello",
+		"localhost /paste/.git/x.txt 5": "hello",
+		"localhost /paste/ 8":           "\x89PNG\r\n\x1a\n",
+	} {
+		res := spartanUpload(c, request, body)
+		if !strings.HasPrefix(res, "4 ") {
+			t.Errorf("%s should have been refused: %q", request, res)
+		}
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 0 {
+		t.Errorf("refused uploads were written")
+	}
+}
+
+func TestGopherMenu(t *testing.T) {
+	h := gopher.Hole{Host: "example.com"}
+	var buf bytes.Buffer
+	err := h.Handle("\r\n", &buf)
+	if err != nil {
+		t.Errorf("request shouldn't have failed: %v", err)
+	}
+	menu := buf.String()
+	if !strings.Contains(menu, "0README.gmi\t/README.gmi\texample.com\t70\r\n") ||
+		!strings.Contains(menu, "1gemini/\t/gemini/\texample.com\t70\r\n") ||
+		!strings.HasSuffix(menu, ".\r\n") {
+		t.Errorf("unexpected menu %q", menu)
+	}
+}
+
+func TestGophermap(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "phlog"), 0755)
+	gophermap := "welcome\n0first post\tfirst.txt\n1elsewhere\t/\tother.host\t7070\n1no port\t/\tthird.host\n"
+	os.WriteFile(filepath.Join(root, "phlog", "gophermap"), []byte(gophermap), 0644)
+	h := gopher.Hole{Root: root}
+	var buf bytes.Buffer
+	h.Handle("/phlog\r\n", &buf)
+	expected := "iwelcome\t\tlocalhost\t70\r\n" +
+		"0first post\t/phlog/first.txt\tlocalhost\t70\r\n" +
+		"1elsewhere\t/\tother.host\t7070\r\n" +
+		"1no port\t/\tthird.host\t70\r\n" +
+		".\r\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected menu %q", buf.String())
+	}
+}
+
+func TestGopherFile(t *testing.T) {
+	var h gopher.Hole
+	var buf bytes.Buffer
+	err := h.Handle("/cgi-bin/env.cgi\r\n", &buf)
+	if err != nil {
+		t.Errorf("request shouldn't have failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), "cgi-bin /cgi-bin/env.cgi") {
+		t.Errorf("unexpected response %q", buf.String())
+	}
+	buf.Reset()
+	err = h.Handle("/../etc/passwd\r\n", &buf)
+	if err == nil || !strings.HasPrefix(buf.String(), "3") {
+		t.Errorf("traversal should have failed: %q", buf.String())
+	}
+	buf.Reset()
+	err = h.Handle("/notFound\r\n", &buf)
+	if err == nil || !strings.HasPrefix(buf.String(), "3not found") {
+		t.Errorf("missing file should have failed: %q", buf.String())
+	}
+}
+
+func TestGopherRequest(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := bufio.NewReader(conn).ReadString('\n')
+		h := gopher.Hole{}
+		h.Handle(request, conn)
+	}()
+	res, err := gopher.Request(context.Background(), "gopher://"+l.Addr().String()+"/0/hello.cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	body, _ := io.ReadAll(res)
+	if res.Type != gopher.Text || !strings.Contains(string(body), "hello world") {
+		t.Errorf("unexpected response %c %q", res.Type, body)
+	}
+}
+
+func fingerRoot(t *testing.T) string {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "alice.plan"), []byte("gardening\nmostly\n"), 0644)
+	script := "#!/bin/sh\necho \"$FINGER_USER $FINGER_VERBOSE\"\n"
+	os.WriteFile(filepath.Join(root, "bob.cgi"), []byte(script), 0755)
+	return root
+}
+
+func TestFinger(t *testing.T) {
+	h := finger.Hand{Root: fingerRoot(t)}
+	for request, expected := range map[string]string{
+		"alice\r\n":           "gardening\r\nmostly\r\n",
+		"/W bob\r\n":          "bob 1\n",
+		"\r\n":                "alice\r\nbob\r\n",
+		"carol\r\n":           "no such user\r\n",
+		"alice@elsewhere\r\n": "finger forwarding service denied\r\n",
+	} {
+		var buf bytes.Buffer
+		h.Handle(request, &buf)
+		if buf.String() != expected {
+			t.Errorf("%q: unexpected response %q", request, buf.String())
+		}
+	}
+}
+
+func TestFingerRequest(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	root := fingerRoot(t)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := bufio.NewReader(conn).ReadString('\n')
+		h := finger.Hand{Root: root}
+		h.Handle(request, conn)
+	}()
+	res, err := finger.Request(context.Background(), "alice@"+l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	body, _ := io.ReadAll(res)
+	if string(body) != "gardening\r\nmostly\r\n" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
+
+func TestNex(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "log", "2024"), 0755)
+	os.WriteFile(filepath.Join(root, "log", "first post.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(root, "log", "secret.cgi"), []byte("#!/bin/sh"), 0755)
+	s := nex.Station{Root: root}
+	for request, expected := range map[string]string{
+		"/log/\r\n":               "=> /log/2024/ 2024/\n=> /log/first%20post.txt first post.txt\n",
+		"/log\n":                  "=> /log/2024/ 2024/\n=> /log/first%20post.txt first post.txt\n",
+		"/log/first post.txt\r\n": "hello",
+		"/log/secret.cgi\r\n":     "not found\n",
+		"/../etc/passwd\r\n":      "invalid path\n",
+	} {
+		var buf bytes.Buffer
+		s.Handle(request, &buf)
+		if buf.String() != expected {
+			t.Errorf("%q: unexpected response %q", request, buf.String())
+		}
+	}
+}
+
+func TestNexRequest(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := bufio.NewReader(conn).ReadString('\n')
+		s := nex.Station{}
+		s.Handle(request, conn)
+	}()
+	res, err := nex.Request(context.Background(), "nex://"+l.Addr().String()+"/cgi-bin/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	body, _ := io.ReadAll(res)
+	if string(body) != "=> /cgi-bin/hello hello\n" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
+
+type lossy struct {
+	net.PacketConn
+	n int
+}
+
+func (l *lossy) WriteTo(p []byte, addr net.Addr) (int, error) {
+	l.n++
+	if l.n%3 == 0 {
+		return len(p), nil
+	}
+	return l.PacketConn.WriteTo(p, addr)
+}
+
+func guppyServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	tank := &guppy.Tank{Capsule: &gemini.Capsule{}, ChunkSize: 64, Timeout: 100 * time.Millisecond}
+	go tank.Serve(&lossy{PacketConn: conn})
+	return conn.LocalAddr().String()
+}
+
+func TestGuppy(t *testing.T) {
+	addr := guppyServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := guppy.Request(ctx, "guppy://"+addr+"/README.gmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readme, _ := os.ReadFile("README.gmi")
+	if res.Status != guppy.Success || res.Header != "text/gemini" || !bytes.Equal(res.Body, readme) {
+		t.Errorf("unexpected response %d %q (%d bytes)", res.Status, res.Header, len(res.Body))
+	}
+}
+
+func TestGuppyNotFound(t *testing.T) {
+	addr := guppyServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := guppy.Request(ctx, "guppy://"+addr+"/notFound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != guppy.Error {
+		t.Errorf("unexpected status %d %q", res.Status, res.Header)
+	}
+}
+
+func TestGuppyUnacknowledged(t *testing.T) {
+	addr := guppyServer(t)
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "guppy://%s/README.gmi\r\n", addr)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2048)
+	seqs := map[string]bool{}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		line, _, _ := bytes.Cut(buf[:n], []byte("\r\n"))
+		seq, _, _ := strings.Cut(string(line), " ")
+		seqs[seq] = true
+	}
+	if len(seqs) != 1 {
+		t.Errorf("sent %d chunks before any acknowledgement", len(seqs))
+	}
+}
+
+func identity(t *testing.T, uid, name, host string) tls.Certificate {
+	return issue(t, uid, name, host, nil)
+}
+
+// a misfin identity signed by parent, or self signed when parent is nil
+func issue(t *testing.T, uid, name, host string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: name,
+			ExtraNames: []pkix.AttributeTypeAndValue{
+				{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, Value: uid},
+			},
+		},
+		DNSNames:  []string{host},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	issuer, signer := &template, any(key)
+	if parent != nil {
+		issuer, _ = x509.ParseCertificate(parent.Certificate[0])
+		signer = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func misfinServer(t *testing.T, postbox *misfin.Postbox) string {
+	cert := identity(t, "postmaster", "postbox", "localhost")
+	config := tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequestClientCert}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			request, _ := reader.ReadString('\n')
+			postbox.Handle(request, &natto.Conn{Conn: conn, Reader: reader})
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// a postbox trusting mailserver as the server for example.com
+func postbox(root string, mailserver tls.Certificate) *misfin.Postbox {
+	return &misfin.Postbox{
+		Root:        root,
+		Fingerprint: "abc",
+		Lookup: func(ctx context.Context, host string) (*x509.Certificate, error) {
+			if host != "example.com" {
+				return nil, fmt.Errorf("no such host")
+			}
+			return x509.ParseCertificate(mailserver.Certificate[0])
+		},
+	}
+}
+
+func TestMisfin(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "alice.gmi"), nil, 0644)
+	mailserver := identity(t, "postmaster", "example.com", "example.com")
+	addr := misfinServer(t, postbox(root, mailserver))
+	sender := issue(t, "bob", "Bob", "example.com", &mailserver)
+
+	ctx := context.Background()
+	res, err := misfin.Send(ctx, "alice@"+addr, "# hi\n< eve@example.com Eve\n@ 2000-01-01\n", sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != misfin.Success || res.Header != "abc" {
+		t.Errorf("unexpected response %d %q", res.Status, res.Header)
+	}
+	mbox, _ := os.ReadFile(filepath.Join(root, "alice.gmi"))
+	if !strings.HasPrefix(string(mbox), "< bob@example.com Bob\n@ ") ||
+		!strings.HasSuffix(string(mbox), "\n# hi\n < eve@example.com Eve\n @ 2000-01-01\n\n") {
+		t.Errorf("unexpected mailbox %q", mbox)
+	}
+
+	res, err = misfin.Send(ctx, "carol@"+addr, "hello", sender)
+	if err != nil || res.Status != misfin.MailboxNotFound {
+		t.Errorf("unexpected response %v %v", res, err)
+	}
+}
+
+func TestMisfinForged(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "alice.gmi"), nil, 0644)
+	mailserver := identity(t, "postmaster", "example.com", "example.com")
+	addr := misfinServer(t, postbox(root, mailserver))
+	ctx := context.Background()
+
+	res, err := misfin.Send(ctx, "alice@"+addr, "hello", identity(t, "bob", "Bob", "example.com"))
+	if err != nil || res.Status != misfin.CertificateNotValid {
+		t.Errorf("unexpected response %v %v", res, err)
+	}
+	res, err = misfin.Send(ctx, "alice@"+addr, "hello", issue(t, "bob", "Bob", "friends.net", &mailserver))
+	if err != nil || res.Status != misfin.CertificateNotValid {
+		t.Errorf("unexpected response %v %v", res, err)
+	}
+	res, err = misfin.Send(ctx, "alice@"+addr, "hello", issue(t, "bob", "Bob", "example.com:25", &mailserver))
+	if err != nil || res.Status != misfin.CertificateNotValid {
+		t.Errorf("unexpected response %v %v", res, err)
+	}
+	mbox, _ := os.ReadFile(filepath.Join(root, "alice.gmi"))
+	if len(mbox) != 0 {
+		t.Errorf("forged mail was delivered: %q", mbox)
+	}
+}
+
+func TestMisfinServerCertificate(t *testing.T) {
+	ctx := context.Background()
+	for _, host := range []string{"localhost", "127.0.0.1", "example.com:25", "100.64.0.1"} {
+		_, err := misfin.ServerCertificate(ctx, host)
+		if err == nil {
+			t.Errorf("%s shouldn't have been dialled", host)
+		}
+	}
+}
+
+func TestMisfinSenders(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "alice.gmi"), nil, 0644)
+	addr := misfinServer(t, &misfin.Postbox{Root: root, Senders: []string{"*@friends.net"}})
+	ctx := context.Background()
+
+	res, err := misfin.Send(ctx, "alice@"+addr, "hello", identity(t, "bob", "Bob", "example.com"))
+	if err != nil || res.Status != misfin.UnauthorisedSender {
+		t.Errorf("unexpected response %v %v", res, err)
+	}
+	res, err = misfin.Send(ctx, "alice@"+addr, "hello", identity(t, "", "nobody", "friends.net"))
+	if err != nil || res.Status != misfin.CertificateNotValid {
+		t.Errorf("unexpected response %v %v", res, err)
+	}
+	res, err = misfin.Send(ctx, "alice@"+addr, "hello", tls.Certificate{})
+	if err != nil || res.Status != misfin.CertificateRequired {
+		t.Errorf("unexpected response %v %v", res, err)
+	}
+	mbox, _ := os.ReadFile(filepath.Join(root, "alice.gmi"))
+	if len(mbox) != 0 {
+		t.Errorf("refused mail was delivered: %q", mbox)
+	}
+}
+
+func TestMux(t *testing.T) {
+	mux := &natto.Mux{
+		TLS:      &tls.Config{Certificates: []tls.Certificate{identity(t, "", "localhost", "localhost")}},
+		Gemini:   &gemini.Capsule{},
+		Spartan:  &spartan.Space{},
+		Selector: &gopher.Hole{},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go mux.Serve(conn)
+		}
+	}()
+
+	request := func(secure bool, request string) string {
+		var conn net.Conn
+		var err error
+		if secure {
+			conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		} else {
+			conn, err = net.Dial("tcp", l.Addr().String())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, request)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return line
+	}
+	for _, c := range []struct {
+		secure   bool
+		request  string
+		expected string
+	}{
+		{true, "gemini://localhost/README.gmi\r\n", "20 text/gemini\r\n"},
+		{false, "gemini://localhost/README.gmi\r\n", "20 text/gemini\r\n"},
+		{false, "localhost /README.gmi 0\r\n", "2 text/gemini\r\n"},
+		{false, "/cgi-bin\r\n", "0env.cgi\t/cgi-bin/env.cgi\tlocalhost\t70\r\n"},
+	} {
+		line := request(c.secure, c.request)
+		if line != c.expected {
+			t.Errorf("%q: unexpected response %q", c.request, line)
+		}
+	}
+}
+
+func TestVhosts(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "README.gmi"), []byte("# elsewhere\n"), 0644)
+	for _, c := range []struct {
+		request  string
+		protocol string
+		expected string
+	}{
+		{"gemini://example.com/README.gmi\r\n", "gemini", "# elsewhere\n"},
+		{"gemini://EXAMPLE.com:1965/README.gmi\r\n", "gemini", "# elsewhere\n"},
+		{"example.com /README.gmi 0\r\n", "spartan", "# elsewhere\n"},
+		{"gemini://localhost/README.gmi\r\n", "gemini", "# natto\n"},
+	} {
+		hosts := &natto.Vhosts{Default: &gemini.Capsule{}}
+		hosts.Hosts = map[string]natto.Capsule{"example.com": &gemini.Capsule{Root: root}}
+		if c.protocol == "spartan" {
+			hosts.Default = &spartan.Space{}
+			hosts.Hosts["example.com"] = &spartan.Space{Root: root}
+		}
+		var buf bytes.Buffer
+		hosts.Handle(c.request, &buf)
+		buf.ReadString('\n')
+		line, _ := buf.ReadString('\n')
+		if line != c.expected {
+			t.Errorf("%q: unexpected body %q", c.request, line)
+		}
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestDaemon(t *testing.T) {
+	gem, space := freeAddr(t), freeAddr(t)
+	daemon := &natto.Daemon{MaxConns: 1}
+	daemon.Listeners = []natto.Listener{
+		{Protocol: "gemini", Addr: gem, Serve: func(c net.Conn) { natto.Serve(c, &gemini.Capsule{}) }},
+		{Protocol: "spartan", Addr: space, Serve: func(c net.Conn) { natto.Serve(c, &spartan.Space{}) }},
+	}
+	go daemon.Run()
+
+	for _, c := range []struct {
+		addr     string
+		request  string
+		expected string
+	}{
+		{gem, "gemini://localhost/README.gmi\r\n", "20 text/gemini\r\n"},
+		{space, "localhost /README.gmi 0\r\n", "2 text/gemini\r\n"},
+		{gem, "gemini://localhost/missing.gmi\r\n", "51 "},
+	} {
+		var conn net.Conn
+		var err error
+		for range 50 {
+			conn, err = net.Dial("tcp", c.addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, c.request)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if !strings.HasPrefix(line, c.expected) {
+			t.Errorf("%q: unexpected response %q", c.request, line)
+		}
+	}
+}
+
+func TestDaemonBadAddress(t *testing.T) {
+	daemon := &natto.Daemon{Listeners: []natto.Listener{
+		{Protocol: "gemini", Addr: freeAddr(t)},
+		{Protocol: "spartan", Addr: "256.0.0.1:300"},
+	}}
+	if daemon.Run() == nil {
+		t.Errorf("daemon shouldn't have started")
+	}
+}
+
+func TestConfigUploads(t *testing.T) {
+	conf, err := natto.ParseConfig("test.conf", strings.NewReader("upload-size 2M\nupload-types text/plain image/png\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Check(nil) == nil {
+		t.Errorf("uploads should only be allowed where they're asked for")
+	}
+	err = conf.Check(nil, "upload-size", "upload-types")
+	if err != nil {
+		t.Errorf("config should have checked out: %v", err)
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	size := natto.Size(1 << 20)
+	set.Var(&size, "z", "")
+	types := set.String("y", "", "")
+	err = conf.Flags(set, map[string]string{"upload-size": "z", "upload-types": "y"})
+	if err != nil || size != 2<<20 || *types != "text/plain,image/png" {
+		t.Errorf("unexpected flags %v %d %q", err, size, *types)
+	}
+	for _, bad := range []string{"upload-size lots", "upload-types plain"} {
+		if _, err := natto.ParseConfig("test.conf", strings.NewReader(bad)); err == nil {
+			t.Errorf("%s should have been refused", bad)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	conf, err := natto.ParseConfig("test.conf", strings.NewReader(`# a comment
+root .
+listen gemini :1965 tls
+listen spartan
+host example.com cgi-bin # trailing comment
+cgi dir cgi-bin
+cgi extension .sh .cgi
+cgi-timeout 5s
+strict
+redirect /old.gmi /new.gmi
+redirect permanent /gone.gmi gemini://example.com/
+allow 127.0.0.1 10.0.0.0/8
+deny all
+mime .gmni text/gemini
+index index.gmi index.cgi
+listing
+route /app scgi:///run/app.sock
+log natto.log
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Backends) != 1 || conf.Backends[0].URL != "scgi:///run/app.sock" {
+		t.Errorf("unexpected backends %v", conf.Backends)
+	}
+	if len(conf.Index) != 2 || !conf.Listing {
+		t.Errorf("unexpected directory settings")
+	}
+	if conf.Root != "." || len(conf.Listen) != 2 || !conf.Listen[0].TLS || conf.Listen[1].Addr != "" {
+		t.Errorf("unexpected listeners %v", conf.Listen)
+	}
+	if len(conf.Cgi.Extensions) != 2 {
+		t.Errorf("unexpected cgi settings")
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	timeout := set.Duration("t", time.Second, "")
+	strict := set.Bool("s", false, "")
+	err = conf.Flags(set, map[string]string{"cgi-timeout": "t", "strict": "s"})
+	if err != nil || *timeout != 5*time.Second || !*strict {
+		t.Errorf("unexpected flags %v %v %v", err, *timeout, *strict)
+	}
+	if !filepath.IsAbs(conf.Log) || filepath.Base(conf.Log) != "natto.log" {
+		t.Errorf("log %s should have been made absolute", conf.Log)
+	}
+	if r, _, ok := conf.Redirects.Find("/gone.gmi"); !ok || !r.Permanent {
+		t.Errorf("missing permanent redirect")
+	}
+	if conf.Types[".gmni"] != "text/gemini" {
+		t.Errorf("missing mime override")
+	}
+	err = conf.Check([]string{"gemini+tls", "spartan"}, "route")
+	if err != nil {
+		t.Errorf("config should have checked out: %v", err)
+	}
+	for _, c := range []struct {
+		protocols []string
+		line      string
+	}{
+		{[]string{"gemini+tls"}, "test.conf:4: spartan isn't served here"},
+		{[]string{"gemini", "spartan"}, "test.conf:3: gemini over tls isn't served here"},
+		{[]string{"gemini+tls", "spartan+tls"}, "test.conf:4: spartan is only served over tls here"},
+	} {
+		err = conf.Check(c.protocols, "route")
+		if err == nil || err.Error() != c.line {
+			t.Errorf("%v: unexpected error %v", c.protocols, err)
+		}
+	}
+	err = conf.Check([]string{"gemini+tls", "spartan"})
+	if err == nil || !strings.HasSuffix(err.Error(), "route isn't supported here") {
+		t.Errorf("route shouldn't have been allowed: %v", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		conf string
+		line string
+	}{
+		{"root .\nroot /var/gemini\n", "test.conf:2: root already set on line 1"},
+		{"\n\nlisten http :80\n", "test.conf:3: unknown protocol http"},
+		{"frobnicate\n", "test.conf:1: unknown directive frobnicate"},
+		{"host example.com\n", "test.conf:1: wrong number of arguments for host"},
+		{"cgi-timeout soon\n", "test.conf:1: cgi-timeout: "},
+		{"cgi extension sh\n", "test.conf:1: cgi: extension sh doesn't start with ."},
+		{"redirect sometimes /a /b\n", "test.conf:1: expected permanent, not sometimes"},
+		{"allow 10.0.0.0/33\n", "test.conf:1: invalid network 10.0.0.0/33"},
+		{"mime gmi text/gemini\n", "test.conf:1: expected mime .ext type/subtype"},
+		{"index docs/index.gmi\n", "test.conf:1: index docs/index.gmi isn't a file name"},
+		{"listing\nlisting\n", "test.conf:2: listing already set on line 1"},
+		{"route /app fastcgi://localhost\n", "test.conf:1: route: fastcgi://localhost lacks a port"},
+	} {
+		_, err := natto.ParseConfig("test.conf", strings.NewReader(c.conf))
+		if err == nil || !strings.HasPrefix(err.Error(), c.line) {
+			t.Errorf("%q: unexpected error %v", c.conf, err)
+		}
+	}
+	conf, _ := natto.ParseConfig("test.conf", strings.NewReader("root .\nhost example.com missing\n"))
+	err := conf.Check(nil)
+	if err == nil || err.Error() != "test.conf:2: missing isn't a directory" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	conf, err := natto.ParseConfig("test.conf", strings.NewReader("deny 10.1.0.0/16\nallow 10.0.0.0/8 ::1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[string]bool{
+		"10.2.3.4": true,
+		"10.1.3.4": false,
+		"::1":      true,
+		"8.8.8.8":  false,
+	} {
+		if conf.Access.Permits(&net.TCPAddr{IP: net.ParseIP(addr)}) != expected {
+			t.Errorf("%s should have been %v", addr, expected)
+		}
+	}
+	if !(natto.Access{}).Permits(&net.TCPAddr{IP: net.ParseIP("8.8.8.8")}) {
+		t.Errorf("no rules should let everyone in")
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "blog"), 0755)
+	os.WriteFile(filepath.Join(root, "blog", natto.RedirectFile), []byte(`# moved posts
+redirect permanent (\d+)\.gmi posts/$1.gmi
+gone secret.gmi
+redirect draft.gmi /drafts/
+`), 0644)
+	redirects, err := natto.ParseRedirects("test.conf", strings.NewReader(`redirect /old.gmi /new.gmi
+redirect permanent /moved/(.*) gemini://example.com/$1
+gone /deleted.gmi
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		capsule  natto.Capsule
+		request  string
+		expected string
+	}{
+		{&gemini.Capsule{Root: root, Redirects: redirects}, "gemini://localhost/old.gmi\r\n", "30 /new.gmi\r\n"},
+		{&gemini.Capsule{Root: root, Redirects: redirects}, "gemini://localhost/moved/a/b.gmi\r\n", "31 gemini://example.com/a/b.gmi\r\n"},
+		{&gemini.Capsule{Root: root, Redirects: redirects}, "gemini://localhost/deleted.gmi\r\n", "52 gone\r\n"},
+		{&gemini.Capsule{Root: root}, "gemini://localhost/blog/2024.gmi\r\n", "31 /blog/posts/2024.gmi\r\n"},
+		{&gemini.Capsule{Root: root}, "gemini://localhost/blog/secret.gmi\r\n", "52 gone\r\n"},
+		{&gemini.Capsule{Root: root}, "gemini://localhost/blog/draft.gmi\r\n", "30 /drafts/\r\n"},
+		{&gemini.Capsule{Root: root}, "gemini://localhost/blog/about.gmi\r\n", "51 "},
+		{&spartan.Space{Root: root, Redirects: redirects}, "localhost /old.gmi 0\r\n", "3 /new.gmi\r\n"},
+		{&spartan.Space{Root: root, Redirects: redirects}, "localhost /moved/a.gmi 0\r\n", "4 not found\r\n"},
+		{&spartan.Space{Root: root, Redirects: redirects}, "localhost /deleted.gmi 0\r\n", "4 gone\r\n"},
+		{&spartan.Space{Root: root}, "localhost /blog/2024.gmi 0\r\n", "3 /blog/posts/2024.gmi\r\n"},
+	} {
+		var buf bytes.Buffer
+		c.capsule.Handle(c.request, &buf)
+		line, _ := buf.ReadString('\n')
+		if !strings.HasPrefix(line, c.expected) {
+			t.Errorf("%q: unexpected response %q", c.request, line)
+		}
+	}
+}
+
+func TestRedirectErrors(t *testing.T) {
+	_, err := natto.ParseRedirects("blog/.redirects", strings.NewReader("gone a.gmi\nredirect (unclosed /b\n"))
+	if err == nil || err.Error() != "blog/.redirects:2: invalid pattern (unclosed" {
+		t.Errorf("unexpected error %v", err)
+	}
+	_, err = natto.ParseConfig("test.conf", strings.NewReader("gone\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "test.conf:1: ") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestGeminiDirectory(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs", "sub dir"), 0755)
+	os.MkdirAll(filepath.Join(root, "app"), 0755)
+	os.MkdirAll(filepath.Join(root, "empty"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.gmi"), []byte("# a\n"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", ".hidden"), []byte("shh\n"), 0644)
+	os.WriteFile(filepath.Join(root, "app", "index.cgi"), []byte("#!/bin/sh\nprintf '20 text/plain\\r\\napp\\n'\n"), 0755)
+	os.WriteFile(filepath.Join(root, "app", "index.txt"), []byte("plain\n"), 0644)
+
+	for _, c := range []struct {
+		capsule  *gemini.Capsule
+		request  string
+		expected string
+	}{
+		{&gemini.Capsule{Root: root}, "gemini://localhost/docs\r\n", "31 /docs/\r\n"},
+		{&gemini.Capsule{Root: root}, "gemini://localhost/docs?q\r\n", "31 /docs/?q\r\n"},
+		{&gemini.Capsule{Root: root}, "gemini://localhost/docs/\r\n", "51 not found\r\n"},
+		{&gemini.Capsule{Root: root}, "gemini://localhost/app/\r\n", "20 text/plain\r\napp\n"},
+		{&gemini.Capsule{Root: root, Index: []string{"index.txt"}}, "gemini://localhost/app/\r\n", "20 text/plain\r\nplain\n"},
+		{&gemini.Capsule{Root: root, Cgi: natto.CgiRules{Off: true}}, "gemini://localhost/app/\r\n", "51 not found\r\n"},
+		{&gemini.Capsule{Root: root, Listing: true}, "gemini://localhost/docs/\r\n",
+			"20 text/gemini\r\n# /docs/\n\n=> /docs/a.gmi a.gmi\n=> /docs/sub%20dir/ sub dir/\n"},
+		{&gemini.Capsule{Root: root, Listing: true}, "gemini://localhost/empty/\r\n", "20 text/gemini\r\n# /empty/\n\n"},
+	} {
+		var buf bytes.Buffer
+		c.capsule.Handle(c.request, &buf)
+		if buf.String() != c.expected {
+			t.Errorf("%q: unexpected response %q", c.request, buf.String())
+		}
+	}
+}
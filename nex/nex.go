@@ -0,0 +1,145 @@
+package nex
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"blekksprut.net/natto"
+)
+
+// serves files as they are. directories serve their index file, or a
+// listing of => links when there is none
+type Station struct {
+	Root string
+	FS   fs.FS
+}
+
+type Response struct {
+	URL  *url.URL
+	Raw  io.Reader
+	Conn net.Conn
+}
+
+func (s *Station) validate(request string) (string, error) {
+	if len(request) > 1024 {
+		return "", fmt.Errorf("too long")
+	}
+	p := strings.TrimRight(request, "\r\n")
+	if strings.ContainsAny(p, "\r\n\t") {
+		return "", fmt.Errorf("invalid path")
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("invalid path")
+		}
+	}
+	return "/" + strings.TrimPrefix(p, "/"), nil
+}
+
+func (s *Station) Handle(request string, rw io.ReadWriter) error {
+	if s.FS == nil {
+		if s.Root == "" {
+			s.Root = "."
+		}
+		s.FS = os.DirFS(s.Root)
+	}
+
+	p, err := s.validate(request)
+	if err != nil {
+		fmt.Fprintln(rw, err.Error())
+		return err
+	}
+	name := strings.Trim(p, "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(s.FS, name)
+	if err != nil || natto.Mime(name) == "application/cgi" {
+		fmt.Fprintln(rw, "not found")
+		return fmt.Errorf("file not found")
+	}
+	if info.IsDir() {
+		index := path.Join(name, "index")
+		if _, err := fs.Stat(s.FS, index); err != nil {
+			return s.listing(rw, name)
+		}
+		name = index
+	}
+	f, err := s.FS.Open(name)
+	if err != nil {
+		fmt.Fprintln(rw, "unreadable")
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(rw, f)
+	return err
+}
+
+func (s *Station) listing(w io.Writer, dir string) error {
+	entries, err := fs.ReadDir(s.FS, dir)
+	if err != nil {
+		fmt.Fprintln(w, "unreadable")
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || natto.Mime(name) == "application/cgi" {
+			continue
+		}
+		link := (&url.URL{Path: "/" + path.Join(dir, name)}).EscapedPath()
+		if entry.IsDir() {
+			name, link = name+"/", link+"/"
+		}
+		fmt.Fprintf(w, "=> %s %s\n", link, name)
+	}
+	return nil
+}
+
+func (r *Response) Close() {
+	r.Conn.Close()
+}
+
+func (r *Response) Read(b []byte) (int, error) {
+	return r.Raw.Read(b)
+}
+
+// fetches nex://host[:port]/path
+func Request(ctx context.Context, rawURL string) (*Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "1900")
+	}
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+
+	timeout, _ := time.ParseDuration("30s")
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = fmt.Fprintf(conn, "%s\r\n", p)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Response{u, bufio.NewReader(conn), conn}, nil
+}
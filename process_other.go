@@ -0,0 +1,11 @@
+//go:build !unix
+
+package natto
+
+import (
+	"os/exec"
+)
+
+// no process groups here, a timeout only kills the script itself
+func group(cmd *exec.Cmd) {
+}
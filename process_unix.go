@@ -0,0 +1,17 @@
+//go:build unix
+
+package natto
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// puts the script in its own process group, so a timeout kills
+// whatever it started too
+func group(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,142 @@
+package natto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// the name of per-directory rule files, holding the same redirect and
+// gone lines as the configuration file
+const RedirectFile = ".redirects"
+
+// a redirect or, with Gone set, a tombstone. From is a regular
+// expression matching the whole path, and To can use its captures as
+// $1, $2...
+type Redirect struct {
+	From      string
+	To        string
+	Permanent bool
+	Gone      bool
+	pattern   *regexp.Regexp
+}
+
+type Redirects []Redirect
+
+// parses the arguments of a redirect ([permanent] from to) or gone
+// (from) line
+func ParseRedirect(directive string, args []string) (Redirect, error) {
+	var r Redirect
+	switch {
+	case directive == "gone" && len(args) == 1:
+		r = Redirect{From: args[0], Gone: true}
+	case directive == "redirect" && len(args) == 2:
+		r = Redirect{From: args[0], To: args[1]}
+	case directive == "redirect" && len(args) == 3:
+		if args[0] != "permanent" {
+			return r, fmt.Errorf("expected permanent, not %s", args[0])
+		}
+		r = Redirect{From: args[1], To: args[2], Permanent: true}
+	default:
+		return r, fmt.Errorf("expected redirect [permanent] from to, or gone from")
+	}
+	var err error
+	r.pattern, err = regexp.Compile("^(?:" + r.From + ")$")
+	if err != nil {
+		return r, fmt.Errorf("invalid pattern %s", r.From)
+	}
+	return r, nil
+}
+
+func ParseRedirects(name string, r io.Reader) (Redirects, error) {
+	var redirects Redirects
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		redirect, err := ParseRedirect(fields[0], fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		redirects = append(redirects, redirect)
+	}
+	return redirects, scanner.Err()
+}
+
+func (r Redirect) match(p string) (string, bool) {
+	pattern := r.pattern
+	if pattern == nil {
+		var err error
+		pattern, err = regexp.Compile("^(?:" + r.From + ")$")
+		if err != nil {
+			return "", false
+		}
+	}
+	m := pattern.FindStringSubmatchIndex(p)
+	if m == nil {
+		return "", false
+	}
+	return string(pattern.ExpandString(nil, r.To, p, m)), true
+}
+
+// the first rule matching path, and its target with captures expanded
+func (r Redirects) Find(p string) (Redirect, string, bool) {
+	for _, redirect := range r {
+		if to, ok := redirect.match(p); ok {
+			return redirect, to, true
+		}
+	}
+	return Redirect{}, "", false
+}
+
+// checks the given rules, then the rule files in the directories along
+// path, deepest first. patterns in those files match the path below
+// their directory, and relative targets resolve against it
+func FindRedirect(fsys fs.FS, redirects Redirects, p string) (Redirect, string, bool) {
+	if r, to, ok := redirects.Find(p); ok {
+		return r, to, true
+	}
+	if fsys == nil {
+		return Redirect{}, "", false
+	}
+	dir := strings.Trim(p, "/")
+	if !strings.HasSuffix(p, "/") {
+		dir = path.Dir(dir)
+	}
+	for {
+		if dir == "" {
+			dir = "."
+		}
+		file := path.Join(dir, RedirectFile)
+		data, err := fs.ReadFile(fsys, file)
+		if err == nil {
+			rules, err := ParseRedirects(file, bytes.NewReader(data))
+			if err != nil {
+				log.Println(err)
+			}
+			base := "/"
+			if dir != "." {
+				base = "/" + dir + "/"
+			}
+			if r, to, ok := rules.Find(strings.TrimPrefix(p, base)); ok {
+				if !strings.HasPrefix(to, "/") && !strings.Contains(to, "://") {
+					to = base + to
+				}
+				return r, to, true
+			}
+		}
+		if dir == "." {
+			return Redirect{}, "", false
+		}
+		dir = path.Dir(dir)
+	}
+}
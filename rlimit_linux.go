@@ -0,0 +1,78 @@
+package natto
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// set in the environment of a re-executed copy of this binary, which
+// applies the limits to itself and then becomes the cgi script, so the
+// script never runs unlimited
+const shim = "NATTO_CGI_RLIMITS"
+
+// the running binary, even after it's been replaced on disk
+const self = "/proc/self/exe"
+
+func rlimits() {
+	spec, ok := os.LookupEnv(shim)
+	if !ok {
+		return
+	}
+	os.Unsetenv(shim)
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "rlimit trouble: no script")
+		os.Exit(1)
+	}
+	// everything exec needs is allocated up front, since the runtime
+	// may not get more memory once the limits are in place
+	path, err := syscall.BytePtrFromString(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cgi trouble: %v\n", err)
+		os.Exit(1)
+	}
+	argv, err := syscall.SlicePtrFromStrings(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cgi trouble: %v\n", err)
+		os.Exit(1)
+	}
+	envv, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cgi trouble: %v\n", err)
+		os.Exit(1)
+	}
+	resources := []int{unix.RLIMIT_CPU, unix.RLIMIT_DATA, unix.RLIMIT_FSIZE}
+	for i, field := range strings.Split(spec, ",") {
+		max, err := strconv.ParseUint(field, 10, 64)
+		if err != nil || i >= len(resources) {
+			fmt.Fprintf(os.Stderr, "rlimit trouble: %s\n", spec)
+			os.Exit(1)
+		}
+		if max == 0 {
+			continue
+		}
+		err = unix.Setrlimit(resources[i], &unix.Rlimit{Cur: max, Max: max})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rlimit trouble: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&argv[0])), uintptr(unsafe.Pointer(&envv[0])))
+	fmt.Fprintf(os.Stderr, "cgi trouble: %v\n", errno)
+	os.Exit(1)
+}
+
+// runs path through the shim when there are limits to apply
+func limited(path string, l Limits) (string, []string, []string) {
+	if l.CPU == 0 && l.Memory == 0 && l.FileSize == 0 {
+		return path, []string{path}, nil
+	}
+	spec := fmt.Sprintf("%s=%d,%d,%d", shim, l.CPU, l.Memory, l.FileSize)
+	return self, []string{self, path}, []string{spec}
+}
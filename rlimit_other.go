@@ -0,0 +1,10 @@
+//go:build !linux
+
+package natto
+
+func rlimits() {}
+
+// cgi scripts run with inherited limits here
+func limited(path string, l Limits) (string, []string, []string) {
+	return path, []string{path}, nil
+}
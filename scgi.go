@@ -0,0 +1,114 @@
+package natto
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scgi closes the connection after every response, so nothing is
+// reused. Conns only caps how many requests the backend sees at once
+type Scgi struct {
+	Network string
+	Address string
+	Timeout time.Duration
+	Conns   int
+	once    sync.Once
+	slots   chan struct{}
+}
+
+func (s *Scgi) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return s.Timeout
+}
+
+func (s *Scgi) acquire() error {
+	s.once.Do(func() {
+		if s.Conns == 0 {
+			s.Conns = 16
+		}
+		s.slots = make(chan struct{}, s.Conns)
+	})
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-time.After(s.timeout()):
+		return fmt.Errorf("%w: no free scgi connections", ErrBackend)
+	}
+}
+
+func (s *Scgi) release() {
+	<-s.slots
+}
+
+func netstring(env []string) []byte {
+	length := "0"
+	var headers bytes.Buffer
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if k == "CONTENT_LENGTH" {
+			length = v
+			continue
+		}
+		fmt.Fprintf(&headers, "%s\x00%s\x00", k, v)
+	}
+	headers.WriteString("SCGI\x001\x00")
+	body := append([]byte("CONTENT_LENGTH\x00"+length+"\x00"), headers.Bytes()...)
+	return fmt.Appendf(nil, "%d:%s,", len(body), body)
+}
+
+func (s *Scgi) Gate(w io.Writer, r io.Reader, env []string) error {
+	err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer s.release()
+
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, s.Address, s.timeout())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBackend, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.timeout()))
+	_, err = conn.Write(netstring(env))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBackend, err)
+	}
+	length, _ := strconv.ParseInt(Getenv(env, "CONTENT_LENGTH"), 10, 64)
+	if length > 0 && r != nil {
+		_, err = io.CopyN(conn, r, length)
+		if err != nil {
+			return fmt.Errorf("scgi trouble: %v", err)
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.timeout()))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			_, werr := w.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBackend, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+//go:build linux && (amd64 || arm64)
+
+package seccomp
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// syscalls shared by every linux architecture, grouped like pledge(2)
+var common = map[string][]uintptr{
+	"stdio": {
+		unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV,
+		unix.SYS_PREAD64, unix.SYS_PWRITE64, unix.SYS_CLOSE,
+		unix.SYS_CLOSE_RANGE, unix.SYS_FSTAT, unix.SYS_LSEEK,
+		unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MREMAP,
+		unix.SYS_MADVISE, unix.SYS_BRK, unix.SYS_FUTEX,
+		unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK,
+		unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK,
+		unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_RESTART_SYSCALL,
+		unix.SYS_GETPID, unix.SYS_GETPPID, unix.SYS_GETTID,
+		unix.SYS_TGKILL, unix.SYS_SCHED_YIELD, unix.SYS_SCHED_GETAFFINITY,
+		unix.SYS_NANOSLEEP, unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_NANOSLEEP,
+		unix.SYS_GETTIMEOFDAY, unix.SYS_GETRANDOM, unix.SYS_UNAME,
+		unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT,
+		unix.SYS_EVENTFD2, unix.SYS_PPOLL, unix.SYS_PSELECT6,
+		unix.SYS_PIPE2, unix.SYS_DUP, unix.SYS_DUP3, unix.SYS_FCNTL,
+		unix.SYS_IOCTL, unix.SYS_UMASK, unix.SYS_GETRLIMIT,
+		unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID,
+		unix.SYS_GETEGID, unix.SYS_GETGROUPS, unix.SYS_GETRESUID,
+		unix.SYS_GETRESGID, unix.SYS_SET_TID_ADDRESS,
+		unix.SYS_SET_ROBUST_LIST, unix.SYS_RSEQ, unix.SYS_MEMBARRIER,
+		unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG,
+		unix.SYS_RECVMSG, unix.SYS_SHUTDOWN, unix.SYS_GETSOCKOPT,
+		unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME,
+		unix.SYS_SOCKETPAIR, unix.SYS_FSYNC, unix.SYS_FDATASYNC,
+		unix.SYS_FTRUNCATE, unix.SYS_SENDFILE, unix.SYS_SPLICE,
+		unix.SYS_COPY_FILE_RANGE,
+	},
+	"rpath": {
+		unix.SYS_OPENAT, unix.SYS_STATX, unix.SYS_READLINKAT,
+		unix.SYS_GETDENTS64, unix.SYS_FACCESSAT, unix.SYS_FACCESSAT2,
+		unix.SYS_GETCWD, unix.SYS_CHDIR, unix.SYS_FCHDIR,
+	},
+	"wpath": {
+		unix.SYS_OPENAT, unix.SYS_GETCWD, unix.SYS_TRUNCATE,
+	},
+	"cpath": {
+		unix.SYS_OPENAT, unix.SYS_MKDIRAT, unix.SYS_UNLINKAT,
+		unix.SYS_RENAMEAT, unix.SYS_RENAMEAT2, unix.SYS_LINKAT,
+		unix.SYS_SYMLINKAT,
+	},
+	"fattr": {
+		unix.SYS_FCHMOD, unix.SYS_FCHMODAT, unix.SYS_FCHOWN,
+		unix.SYS_FCHOWNAT, unix.SYS_UTIMENSAT,
+	},
+	"proc": {
+		unix.SYS_CLONE, unix.SYS_CLONE3, unix.SYS_WAIT4, unix.SYS_WAITID,
+		unix.SYS_KILL, unix.SYS_SETPGID, unix.SYS_GETPGID, unix.SYS_SETSID,
+		unix.SYS_GETSID, unix.SYS_PRLIMIT64, unix.SYS_SETRLIMIT,
+		unix.SYS_PIDFD_OPEN, unix.SYS_PIDFD_SEND_SIGNAL,
+	},
+	"exec": {
+		unix.SYS_EXECVE, unix.SYS_EXECVEAT,
+	},
+	"inet": {
+		unix.SYS_SOCKET, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_ACCEPT,
+		unix.SYS_ACCEPT4, unix.SYS_CONNECT,
+	},
+	"unix": {
+		unix.SYS_SOCKET, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_ACCEPT,
+		unix.SYS_ACCEPT4, unix.SYS_CONNECT,
+	},
+}
+
+func allow(set map[uintptr]bool, nr uintptr) []unix.SockFilter {
+	if set[nr] {
+		return nil
+	}
+	set[nr] = true
+	return []unix.SockFilter{
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: uint32(nr)},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+	}
+}
+
+func Filter(promises string) ([]unix.SockFilter, error) {
+	deny := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+
+	prog := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+	}
+	if x32 != 0 {
+		prog = append(prog,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 0, Jf: 1, K: x32},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+		)
+	}
+
+	set := map[uintptr]bool{}
+	names := strings.Fields(promises)
+	proc := false
+	for _, name := range names {
+		if _, ok := common[name]; !ok {
+			return nil, fmt.Errorf("unknown promise %s", name)
+		}
+		proc = proc || name == "proc"
+	}
+	for _, name := range names {
+		for _, nr := range append(common[name], legacy[name]...) {
+			prog = append(prog, allow(set, nr)...)
+		}
+	}
+
+	// threads are fine without proc, new processes are not. clone3 keeps
+	// its flags in memory the filter can't read, so it claims not to
+	// exist and libc falls back to clone
+	if !proc {
+		prog = append(prog,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: unix.SYS_CLONE3},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)},
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 3, K: unix.SYS_CLONE},
+			unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 16},
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, Jt: 0, Jf: 1, K: unix.CLONE_THREAD},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+			unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		)
+	}
+
+	prog = append(prog, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny})
+	if len(prog) > 4096 {
+		return nil, fmt.Errorf("filter too long")
+	}
+	return prog, nil
+}
+
+func Pledge(promises string) error {
+	prog, err := Filter(promises)
+	if err != nil {
+		return err
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP,
+		unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package seccomp
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const arch = unix.AUDIT_ARCH_X86_64
+
+// x32 syscalls have this bit set and get no say
+const x32 = 0x40000000
+
+var legacy = map[string][]uintptr{
+	"stdio": {
+		unix.SYS_POLL, unix.SYS_SELECT, unix.SYS_EPOLL_WAIT,
+		unix.SYS_EPOLL_CREATE, unix.SYS_PIPE, unix.SYS_DUP2,
+		unix.SYS_ARCH_PRCTL, unix.SYS_TIME, unix.SYS_GETPGRP,
+		unix.SYS_NEWFSTATAT,
+	},
+	"rpath": {
+		unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_ACCESS,
+		unix.SYS_READLINK, unix.SYS_GETDENTS,
+	},
+	"wpath": {
+		unix.SYS_OPEN,
+	},
+	"cpath": {
+		unix.SYS_OPEN, unix.SYS_CREAT, unix.SYS_MKDIR, unix.SYS_RMDIR,
+		unix.SYS_UNLINK, unix.SYS_RENAME, unix.SYS_LINK, unix.SYS_SYMLINK,
+	},
+	"fattr": {
+		unix.SYS_CHMOD, unix.SYS_CHOWN, unix.SYS_LCHOWN, unix.SYS_UTIMES,
+	},
+	"proc": {
+		unix.SYS_FORK, unix.SYS_VFORK,
+	},
+}
@@ -0,0 +1,15 @@
+package seccomp
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const arch = unix.AUDIT_ARCH_AARCH64
+
+const x32 = 0
+
+var legacy = map[string][]uintptr{
+	"stdio": {
+		unix.SYS_FSTATAT,
+	},
+}
@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+
+package seccomp
+
+import (
+	"fmt"
+)
+
+func Pledge(promises string) error {
+	return fmt.Errorf("seccomp not supported here")
+}
@@ -0,0 +1,75 @@
+//go:build linux && (amd64 || arm64)
+
+package natto_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"blekksprut.net/natto"
+	"blekksprut.net/natto/seccomp"
+)
+
+// runs in a copy of the test binary, since a filter can't be lifted
+func lockedDown(script string) {
+	err := natto.StartLauncher()
+	if err == nil {
+		err = seccomp.Pledge("stdio rpath")
+	}
+	if err != nil {
+		fmt.Println("lockdown trouble:", err)
+		os.Exit(1)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			time.Sleep(10 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	fmt.Println("threads ok")
+
+	_, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	fmt.Println("socket:", err)
+	_, err = syscall.ForkExec("/bin/true", []string{"true"}, nil)
+	fmt.Println("fork:", err)
+
+	var buf bytes.Buffer
+	err = natto.Cgi(&buf, nil, script, "gemini")
+	fmt.Printf("cgi: %v %q\n", err, buf.String())
+	os.Exit(0)
+}
+
+func TestSeccomp(t *testing.T) {
+	if script := os.Getenv("NATTO_LOCKED_DOWN"); script != "" {
+		lockedDown(script)
+	}
+	script := filepath.Join(t.TempDir(), "fork.cgi")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"20 $(echo forked)\"\n"), 0755)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSeccomp$")
+	cmd.Env = append(os.Environ(), "NATTO_LOCKED_DOWN="+script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("locked down child failed: %v %s", err, out)
+	}
+	expected := "threads ok\n" +
+		"socket: operation not permitted\n" +
+		"fork: operation not permitted\n" +
+		"cgi: <nil> \"20 forked\\n\"\n"
+	if !strings.HasPrefix(string(out), expected) {
+		t.Errorf("unexpected output %q", out)
+	}
+}
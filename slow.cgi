@@ -0,0 +1,4 @@
+#!/bin/sh
+
+sleep 10
+echo "20 text/plain\r"
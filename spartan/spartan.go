@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"mime"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -23,8 +26,13 @@ const (
 )
 
 type Space struct {
-	Root string
-	FS   fs.FS
+	Root      string
+	FS        fs.FS
+	Strict    bool
+	Cgi       natto.CgiRules
+	Gateways  map[string]natto.Gateway
+	Uploads   *Uploads
+	Redirects natto.Redirects
 }
 
 type Response struct {
@@ -64,7 +72,8 @@ func req(ctx context.Context, rawURL string, d Data, n int) (*Response, error) {
 		u.Host = u.Host + ":300"
 	}
 	timeout, _ := time.ParseDuration("30s")
-	dialer := net.Dialer{Timeout: timeout}
+	dialer := natto.Dialer(ctx)
+	dialer.Timeout = timeout
 	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
 	if err != nil {
 		return nil, err
@@ -100,7 +109,7 @@ func req(ctx context.Context, rawURL string, d Data, n int) (*Response, error) {
 		if loc.Hostname() != "" {
 			return nil, fmt.Errorf("no cross-site redirects")
 		}
-		loc.Host = u.Hostname()
+		loc.Host = u.Host
 		return req(ctx, loc.String(), Data{}, n+1)
 	case Success, ClientError, ServerError:
 		u.Host = strings.TrimSuffix(u.Host, ":300")
@@ -110,24 +119,86 @@ func req(ctx context.Context, rawURL string, d Data, n int) (*Response, error) {
 	}
 }
 
-func (c *Space) validate(request string) (string, string, error) {
+func ValidHeader(line string) error {
+	status, meta, _ := strings.Cut(line, " ")
+	i, err := strconv.Atoi(status)
+	if len(status) != 1 || err != nil {
+		return fmt.Errorf("malformed status")
+	}
+	switch i {
+	case Success:
+		_, _, err := mime.ParseMediaType(meta)
+		if err != nil {
+			return fmt.Errorf("invalid mime type")
+		}
+	case Redirect:
+		if !strings.HasPrefix(meta, "/") {
+			return fmt.Errorf("invalid redirect")
+		}
+	case ClientError, ServerError:
+	default:
+		return fmt.Errorf("invalid status code %s", status)
+	}
+	return nil
+}
+
+func cgiStatus(status int, meta string) string {
+	switch status / 100 {
+	case 2:
+		if meta == "" {
+			meta = "text/gemini"
+		}
+		return fmt.Sprintf("%d %s\r\n", Success, meta)
+	case 3:
+		return fmt.Sprintf("%d %s\r\n", Redirect, meta)
+	}
+	if meta == "" {
+		meta = strings.ToLower(http.StatusText(status))
+	}
+	if status/100 == 4 {
+		return fmt.Sprintf("%d %s\r\n", ClientError, meta)
+	}
+	return fmt.Sprintf("%d %s\r\n", ServerError, meta)
+}
+
+func (c *Space) gateway(rw io.Writer, run func(io.Writer) error) error {
+	w := &natto.Tracker{Writer: rw}
+	h := &natto.Header{
+		Writer:  w,
+		Valid:   ValidHeader,
+		Failure: fmt.Sprintf("%d %s\r\n", ServerError, "invalid cgi response"),
+	}
+	var out io.Writer = w
+	if c.Strict {
+		out = h
+	}
+	t := &natto.HttpHeader{Writer: out, Format: cgiStatus}
+	err := run(t)
+	t.Close()
+	if c.Strict {
+		h.Close()
+	}
+	if err != nil && w.Written == 0 {
+		fmt.Fprintf(rw, "%d %s\r\n", ServerError, "cgi error")
+	}
+	return err
+}
+
+func (c *Space) validate(request string) (string, string, string, error) {
 	request = strings.TrimSpace(request)
 	components := strings.SplitN(request, " ", 3)
 	if len(components) != 3 {
-		return "", "", fmt.Errorf("malformed request")
+		return "", "", "", fmt.Errorf("malformed request")
 	}
-	_, path, length := components[0], components[1], components[2]
+	host, path, length := components[0], components[1], components[2]
 	if path[0] != '/' {
-		return "", "", fmt.Errorf("missing /")
-	}
-	if path[len(path)-1] == '/' {
-		path = path + "index.gmi"
+		return "", "", "", fmt.Errorf("missing /")
 	}
 	_, err := strconv.Atoi(length)
 	if err != nil {
-		return "", "", fmt.Errorf("invalid content length")
+		return "", "", "", fmt.Errorf("invalid content length")
 	}
-	return path, length, nil
+	return host, path, length, nil
 }
 
 func (c *Space) Handle(request string, rw io.ReadWriter) error {
@@ -138,11 +209,62 @@ func (c *Space) Handle(request string, rw io.ReadWriter) error {
 		c.FS = os.DirFS(c.Root)
 	}
 
-	path, length, err := c.validate(request)
+	host, path, length, err := c.validate(request)
 	if err != nil {
 		fmt.Fprintf(rw, "%d %s\r\n", ClientError, "invalid request")
 		return err
 	}
+	n, _ := strconv.ParseInt(length, 10, 64)
+	// spartan can only redirect within the same host
+	if r, to, ok := natto.FindRedirect(c.FS, c.Redirects, path); ok {
+		switch {
+		case r.Gone:
+			fmt.Fprintf(rw, "%d %s\r\n", ClientError, "gone")
+			return nil
+		case strings.HasPrefix(to, "/"):
+			fmt.Fprintf(rw, "%d %s\r\n", Redirect, to)
+			return nil
+		}
+	}
+	prefix, gateway, ok := natto.Route(c.Gateways, host, path)
+	if ok {
+		method := "GET"
+		if n > 0 {
+			method = "POST"
+		}
+		env := []string{
+			"GATEWAY_INTERFACE=CGI/1.1",
+			"SERVER_PROTOCOL=spartan",
+			"REQUEST_METHOD=" + method,
+			"SERVER_NAME=" + host,
+			"CONTENT_LENGTH=" + length,
+			"SCRIPT_NAME=" + prefix,
+			"PATH_INFO=" + strings.TrimPrefix(path, prefix),
+		}
+		return c.gateway(rw, func(w io.Writer) error {
+			return gateway.Gate(w, io.LimitReader(rw, n), env)
+		})
+	}
+
+	script, extra, ok := c.Cgi.Find(c.FS, path)
+	if ok {
+		env := []string{
+			"SERVER_NAME=" + host,
+			"CONTENT_LENGTH=" + length,
+			"SCRIPT_NAME=/" + script,
+			"PATH_INFO=" + extra,
+		}
+		return c.gateway(rw, func(w io.Writer) error {
+			return natto.Cgi(w, io.LimitReader(rw, n),
+				filepath.Join(c.Root, script), "spartan", env...)
+		})
+	}
+	if n > 0 && c.Uploads != nil && c.Uploads.Allowed(path) {
+		return c.store(path, n, rw)
+	}
+	if path[len(path)-1] == '/' {
+		path = path + "index.gmi"
+	}
 	path = strings.TrimPrefix(path, "/")
 
 	info, err := fs.Stat(c.FS, path)
@@ -160,8 +282,8 @@ func (c *Space) Handle(request string, rw io.ReadWriter) error {
 	mime := natto.Mime(path)
 	switch mime {
 	case "application/cgi":
-		os.Setenv("CONTENT_LENGTH", length)
-		return natto.Cgi(rw, c.Root+"/"+info.Name(), "spartan")
+		fmt.Fprintf(rw, "%d %s\r\n", ClientError, "not found")
+		return fmt.Errorf("file not found")
 	default:
 		f, err := c.FS.Open(path)
 		if err != nil {
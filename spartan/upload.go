@@ -0,0 +1,108 @@
+package spartan
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"blekksprut.net/natto"
+)
+
+// stores data sent to paths inside Dirs. data sent to a directory gets
+// a fresh name, with the extension picked from its sniffed mime type
+type Uploads struct {
+	Dirs      []string
+	MaxSize   int64
+	Overwrite bool
+	Types     []string
+}
+
+func (u *Uploads) maxSize() int64 {
+	if u.MaxSize == 0 {
+		return 1 << 20
+	}
+	return u.MaxSize
+}
+
+func (u *Uploads) Allowed(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return slices.ContainsFunc(u.Dirs, func(dir string) bool {
+		dir = strings.Trim(dir, "/")
+		return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+	})
+}
+
+func (u *Uploads) accepts(kind string) bool {
+	if kind == "application/cgi" {
+		return false
+	}
+	return u.Types == nil || slices.Contains(u.Types, kind)
+}
+
+func extension(kind string) string {
+	for ext, t := range natto.Types {
+		if t == kind && ext != ".cgi" {
+			return ext
+		}
+	}
+	exts, _ := mime.ExtensionsByType(kind)
+	if len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+func (c *Space) store(p string, n int64, rw io.ReadWriter) error {
+	if n > c.Uploads.maxSize() {
+		fmt.Fprintf(rw, "%d %s\r\n", ClientError, "upload too large")
+		return fmt.Errorf("upload too large")
+	}
+	head := make([]byte, min(n, 512))
+	_, err := io.ReadFull(rw, head)
+	if err != nil {
+		fmt.Fprintf(rw, "%d %s\r\n", ClientError, "short upload")
+		return err
+	}
+	kind, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !c.Uploads.accepts(kind) {
+		fmt.Fprintf(rw, "%d %s\r\n", ClientError, "unacceptable type "+kind)
+		return fmt.Errorf("unacceptable upload type %s", kind)
+	}
+
+	name := strings.TrimPrefix(path.Clean(p), "/")
+	if strings.HasSuffix(p, "/") {
+		id := make([]byte, 8)
+		rand.Read(id)
+		name = path.Join(name, hex.EncodeToString(id)+extension(kind))
+	}
+	if name == "" || natto.Hidden(name) || c.Cgi.Covers(name) {
+		fmt.Fprintf(rw, "%d %s\r\n", ClientError, "not writable")
+		return fmt.Errorf("not writable")
+	}
+
+	if !c.Uploads.Overwrite {
+		_, err := os.Stat(filepath.Join(c.Root, filepath.FromSlash(name)))
+		if err == nil {
+			fmt.Fprintf(rw, "%d %s\r\n", ClientError, "already exists")
+			return fmt.Errorf("upload target exists")
+		}
+	}
+
+	body := io.MultiReader(bytes.NewReader(head), io.LimitReader(rw, n-int64(len(head))))
+	err = natto.WriteFile(c.Root, name, body, n)
+	if err != nil {
+		fmt.Fprintf(rw, "%d %s\r\n", ServerError, "upload failed")
+		return err
+	}
+	fmt.Fprintf(rw, "%d /%s\r\n", Redirect, name)
+	return nil
+}